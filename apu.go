@@ -0,0 +1,468 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// bits that always read back as 1, 0xFF10 - 0xFF2F
+var apuReadMask = [0x20]byte{
+	0x80, 0x3f, 0x00, 0xff, 0xbf, // NR10 - NR14
+	0xff, 0x3f, 0x00, 0xff, 0xbf, // NR21 - NR24
+	0x7f, 0xff, 0x9f, 0xff, 0xbf, // NR30 - NR34
+	0xff, 0xff, 0x00, 0x00, 0xbf, // NR41 - NR44
+	0x00, 0x00, 0x70, 0xff, // NR50 - NR52
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+}
+
+type APU struct {
+	cpu *CPU
+
+	on   bool
+	regs [0x20]byte
+
+	ch1 square
+	ch2 square
+	ch3 wave
+	ch4 noise
+
+	seqStep byte
+
+	rate    int     // host sample rate
+	time    float64 // output samples until the next one is due
+	samples []int16 // interleaved stereo, handed to the backend once per frame
+	out     []int16
+
+	// dynamic rate control stretches every frame's samples by ratio, close
+	// to 1, pos is where the next output sample falls between the last
+	// frame's final sample and this frame's
+	ratio float64
+	pos   float64
+	last  [2]int16
+
+	accurate bool // band-limited synthesis instead of point sampling
+	blips    [4]blip
+	charge   float32 // high-pass filter
+	capL     float32
+	capR     float32
+
+	volume float32
+	muted  bool
+
+	recorder       *SoundRecorder
+	recordChannels bool           // hotkey recordings split the channels too
+	videoSound     *SoundRecorder // the sound track of a video recording
+}
+
+func NewAPU(cpu *CPU) *APU {
+	a := &APU{cpu: cpu, ratio: 1, volume: 1, accurate: true}
+	a.SetSampleRate(48000)
+	return a
+}
+
+func (a *APU) SetSampleRate(rate int) {
+	a.rate = rate
+	a.time = 0
+
+	// the DMG output capacitor loses this much of its charge per clock
+	a.charge = float32(math.Pow(0.999958, float64(ClockSpeed)/float64(rate)))
+}
+
+// SetAccurate switches between band-limited synthesis and the cheaper point
+// sampling for slow hosts.
+func (a *APU) SetAccurate(on bool) {
+	a.accurate = on
+}
+
+func (a *APU) SampleRate() int {
+	return a.rate
+}
+
+func (a *APU) ReadByte(addr uint16) byte {
+	if addr >= 0xff30 {
+		return a.ch3.ram[addr-0xff30]
+	}
+
+	if addr == 0xff26 {
+		ret := byte(0x70)
+		if a.on {
+			ret |= 0x80
+		}
+		for i, on := range []bool{a.ch1.enabled, a.ch2.enabled, a.ch3.enabled, a.ch4.enabled} {
+			if on {
+				ret |= 1 << uint(i)
+			}
+		}
+		return ret
+	}
+
+	return a.regs[addr-0xff10] | apuReadMask[addr-0xff10]
+}
+
+func (a *APU) WriteByte(addr uint16, value byte) {
+	if addr >= 0xff30 {
+		a.ch3.ram[addr-0xff30] = value
+		return
+	}
+
+	if addr == 0xff26 {
+		a.power(value&0x80 != 0)
+		return
+	}
+
+	if !a.on {
+		return
+	}
+
+	a.regs[addr-0xff10] = value
+
+	switch addr {
+	case 0xff10:
+		a.ch1.sweepPeriod = (value >> 4) & 7
+		a.ch1.sweepNeg = value&0x08 != 0
+		a.ch1.sweepShift = value & 7
+	case 0xff11:
+		a.ch1.duty = value >> 6
+		a.ch1.length.counter = 64 - int(value&0x3f)
+	case 0xff12:
+		a.ch1.env.write(value)
+		if !a.ch1.env.dac() {
+			a.ch1.enabled = false
+		}
+	case 0xff13:
+		a.ch1.freq = a.ch1.freq&0x700 | uint16(value)
+	case 0xff14:
+		a.ch1.freq = a.ch1.freq&0xff | uint16(value&7)<<8
+		a.ch1.length.on = value&0x40 != 0
+		if value&0x80 != 0 {
+			a.ch1.trigger()
+		}
+
+	case 0xff16:
+		a.ch2.duty = value >> 6
+		a.ch2.length.counter = 64 - int(value&0x3f)
+	case 0xff17:
+		a.ch2.env.write(value)
+		if !a.ch2.env.dac() {
+			a.ch2.enabled = false
+		}
+	case 0xff18:
+		a.ch2.freq = a.ch2.freq&0x700 | uint16(value)
+	case 0xff19:
+		a.ch2.freq = a.ch2.freq&0xff | uint16(value&7)<<8
+		a.ch2.length.on = value&0x40 != 0
+		if value&0x80 != 0 {
+			a.ch2.trigger()
+		}
+
+	case 0xff1a:
+		a.ch3.dacOn = value&0x80 != 0
+		if !a.ch3.dacOn {
+			a.ch3.enabled = false
+		}
+	case 0xff1b:
+		a.ch3.length.counter = 256 - int(value)
+	case 0xff1c:
+		a.ch3.volume = (value >> 5) & 3
+	case 0xff1d:
+		a.ch3.freq = a.ch3.freq&0x700 | uint16(value)
+	case 0xff1e:
+		a.ch3.freq = a.ch3.freq&0xff | uint16(value&7)<<8
+		a.ch3.length.on = value&0x40 != 0
+		if value&0x80 != 0 {
+			a.ch3.trigger()
+		}
+
+	case 0xff20:
+		a.ch4.length.counter = 64 - int(value&0x3f)
+	case 0xff21:
+		a.ch4.env.write(value)
+		if !a.ch4.env.dac() {
+			a.ch4.enabled = false
+		}
+	case 0xff22:
+		a.ch4.shift = value >> 4
+		a.ch4.width7 = value&0x08 != 0
+		a.ch4.divisor = value & 7
+	case 0xff23:
+		a.ch4.length.on = value&0x40 != 0
+		if value&0x80 != 0 {
+			a.ch4.trigger()
+		}
+	}
+}
+
+// power switches the APU through NR52, turning it off clears every register
+// but wave RAM.
+func (a *APU) power(on bool) {
+	if on == a.on {
+		return
+	}
+
+	a.on = on
+	if !on {
+		a.regs = [0x20]byte{}
+		a.ch1 = square{}
+		a.ch2 = square{}
+		a.ch3 = wave{ram: a.ch3.ram}
+		a.ch4 = noise{}
+	} else {
+		a.seqStep = 0
+	}
+}
+
+// clockSequencer is the 512 Hz frame sequencer, clocked from DIV.
+func (a *APU) clockSequencer() {
+	if !a.on {
+		return
+	}
+
+	switch a.seqStep {
+	case 0, 4:
+		a.clockLength()
+	case 2, 6:
+		a.clockLength()
+		a.ch1.clockSweep()
+	case 7:
+		a.ch1.env.clock()
+		a.ch2.env.clock()
+		a.ch4.env.clock()
+	}
+
+	a.seqStep = (a.seqStep + 1) & 7
+}
+
+func (a *APU) clockLength() {
+	if !a.ch1.length.clock() {
+		a.ch1.enabled = false
+	}
+	if !a.ch2.length.clock() {
+		a.ch2.enabled = false
+	}
+	if !a.ch3.length.clock() {
+		a.ch3.enabled = false
+	}
+	if !a.ch4.length.clock() {
+		a.ch4.enabled = false
+	}
+}
+
+func (a *APU) Tick(cycles uint16) {
+	c := int(cycles)
+	step := float64(a.rate) / ClockSpeed
+
+	if !a.accurate {
+		a.stepChannels(c)
+		a.time += float64(c) * step
+		for a.time >= 1 {
+			a.time--
+			a.sample(a.outputs())
+		}
+		return
+	}
+
+	for c > 0 {
+		n := 4
+		if c < n {
+			n = c
+		}
+		c -= n
+
+		a.stepChannels(n)
+		a.time += float64(n) * step
+
+		for i, o := range a.outputs() {
+			a.blips[i].set(a.time, o)
+		}
+
+		for a.time >= 1 {
+			a.time--
+
+			var outs [4]float32
+			for i := range a.blips {
+				outs[i] = a.blips[i].read()
+			}
+			a.sample(outs)
+		}
+	}
+}
+
+func (a *APU) stepChannels(cycles int) {
+	if !a.on {
+		return
+	}
+
+	a.ch1.step(cycles)
+	a.ch2.step(cycles)
+	a.ch3.step(cycles)
+	a.ch4.step(cycles)
+}
+
+// dac converts a 4 bit channel output to -1..1
+func dac(on bool, v byte) float32 {
+	if !on {
+		return 0
+	}
+	return float32(v)/7.5 - 1
+}
+
+// outputs returns the analog level of all four channels.
+func (a *APU) outputs() [4]float32 {
+	return [4]float32{
+		dac(a.ch1.env.dac(), a.ch1.output()),
+		dac(a.ch2.env.dac(), a.ch2.output()),
+		dac(a.ch3.dacOn, a.ch3.output()),
+		dac(a.ch4.env.dac(), a.ch4.output()),
+	}
+}
+
+// sample mixes one output sample from the channel levels.
+func (a *APU) sample(outs [4]float32) {
+	var left, right float32
+
+	if a.on {
+		nr50 := a.regs[0x14]
+		nr51 := a.regs[0x15]
+
+		for i, o := range outs {
+			if nr51&(0x10<<uint(i)) != 0 {
+				left += o
+			}
+			if nr51&(1<<uint(i)) != 0 {
+				right += o
+			}
+		}
+
+		left *= float32((nr50>>4)&7+1) / 8 / 4
+		right *= float32(nr50&7+1) / 8 / 4
+	}
+
+	// DC blocking capacitor
+	l := left - a.capL
+	a.capL = left - l*a.charge
+	r := right - a.capR
+	a.capR = right - r*a.charge
+
+	a.samples = append(a.samples, clamp(l), clamp(r))
+
+	if a.recorder != nil {
+		if err := a.recorder.add(clamp(l), clamp(r), outs); err != nil {
+			fmt.Printf("Sound recording failed: %v\n", err)
+			a.StopRecording()
+		}
+	}
+	if a.videoSound != nil {
+		if err := a.videoSound.add(clamp(l), clamp(r), outs); err != nil {
+			fmt.Printf("Video recording failed: %v\n", err)
+			a.cpu.StopVideo()
+		}
+	}
+}
+
+func clamp(v float32) int16 {
+	if v > 1 {
+		return 32767
+	} else if v < -1 {
+		return -32767
+	}
+	return int16(v * 32767)
+}
+
+// StartRecording writes everything the APU plays to a WAV file until
+// StopRecording.
+func (a *APU) StartRecording(path string, perChannel bool) error {
+	a.StopRecording()
+
+	r, err := NewSoundRecorder(path, a.rate, perChannel)
+	if err != nil {
+		return err
+	}
+	a.recorder = r
+	return nil
+}
+
+func (a *APU) StopRecording() error {
+	if a.recorder == nil {
+		return nil
+	}
+
+	err := a.recorder.Close()
+	a.recorder = nil
+	return err
+}
+
+func (a *APU) Recording() bool {
+	return a.recorder != nil
+}
+
+// flush hands the samples of the last frame to the audio backend.
+func (a *APU) flush() {
+	volume := a.volume
+	if a.muted {
+		volume = 0
+	}
+
+	// linear interpolation, the recorders already got the samples at the
+	// nominal rate
+	a.out = a.out[:0]
+	n := len(a.samples) / 2
+	for ; a.pos < float64(n); a.pos += 1 / a.ratio {
+		i := int(a.pos)
+		f := float32(a.pos - float64(i))
+		for ch := 0; ch < 2; ch++ {
+			prev := a.last[ch]
+			if i > 0 {
+				prev = a.samples[(i-1)*2+ch]
+			}
+			next := a.samples[i*2+ch]
+			v := float32(prev) + (float32(next)-float32(prev))*f
+			a.out = append(a.out, int16(v*volume))
+		}
+	}
+	a.pos -= float64(n)
+	if n > 0 {
+		a.last = [2]int16{a.samples[n*2-2], a.samples[n*2-1]}
+	}
+	a.cpu.backend.Audio.Queue(a.out)
+	a.samples = a.samples[:0]
+
+	// Nudge the output rate by up to half a percent to keep the backend's
+	// queue near audioLatency, that way video pacing and the sound card's
+	// clock can't drift apart into crackles or growing lag.
+	if s, ok := a.cpu.backend.Audio.(AudioSyncer); ok {
+		fill := float64(s.Buffered()) / float64(audioLatency)
+		if fill > 2 {
+			fill = 2
+		}
+		a.ratio = 1 + 0.005*(1-fill)
+	}
+}
+
+func (a *APU) reset() {
+	rate := a.rate
+	*a = APU{cpu: a.cpu, ratio: 1, samples: a.samples[:0], out: a.out[:0], volume: a.volume, muted: a.muted,
+		accurate: a.accurate, recorder: a.recorder, recordChannels: a.recordChannels, videoSound: a.videoSound}
+	a.SetSampleRate(rate)
+}
+
+// SetVolume sets the output volume, 0 to 1.
+func (a *APU) SetVolume(v float32) {
+	if v < 0 {
+		v = 0
+	} else if v > 1 {
+		v = 1
+	}
+	a.volume = v
+}
+
+func (a *APU) Volume() float32 {
+	return a.volume
+}
+
+func (a *APU) SetMuted(m bool) {
+	a.muted = m
+}
+
+func (a *APU) Muted() bool {
+	return a.muted
+}
@@ -0,0 +1,248 @@
+package main
+
+var dutyTable = [4][8]byte{
+	{0, 0, 0, 0, 0, 0, 0, 1}, // 12.5%
+	{1, 0, 0, 0, 0, 0, 0, 1}, // 25%
+	{1, 0, 0, 0, 0, 1, 1, 1}, // 50%
+	{0, 1, 1, 1, 1, 1, 1, 0}, // 75%
+}
+
+var noiseDivisors = [8]int{8, 16, 32, 48, 64, 80, 96, 112}
+
+// wave volume code to right shift
+var waveShift = [4]byte{4, 0, 1, 2}
+
+type envelope struct {
+	initial byte
+	up      bool
+	period  byte
+
+	volume byte
+	timer  byte
+}
+
+func (e *envelope) write(v byte) {
+	e.initial = v >> 4
+	e.up = v&0x08 != 0
+	e.period = v & 0x07
+}
+
+// dac is off when the upper five bits of NRx2 are clear
+func (e *envelope) dac() bool {
+	return e.initial != 0 || e.up
+}
+
+func (e *envelope) trigger() {
+	e.volume = e.initial
+	e.timer = e.period
+	if e.timer == 0 {
+		e.timer = 8
+	}
+}
+
+func (e *envelope) clock() {
+	if e.period == 0 {
+		return
+	}
+
+	e.timer--
+	if e.timer == 0 {
+		e.timer = e.period
+		if e.up && e.volume < 15 {
+			e.volume++
+		} else if !e.up && e.volume > 0 {
+			e.volume--
+		}
+	}
+}
+
+type length struct {
+	counter int
+	on      bool
+}
+
+// clock returns false once the counter expired and the channel stops
+func (l *length) clock() bool {
+	if l.on && l.counter > 0 {
+		l.counter--
+		return l.counter != 0
+	}
+	return true
+}
+
+type square struct {
+	enabled bool
+	length  length
+	env     envelope
+
+	duty  byte
+	pos   byte
+	freq  uint16
+	timer int
+
+	// sweep, channel 1 only
+	sweepPeriod byte
+	sweepNeg    bool
+	sweepShift  byte
+	sweepTimer  byte
+	sweepOn     bool
+	shadow      uint16
+}
+
+func (s *square) step(cycles int) {
+	s.timer -= cycles
+	for s.timer <= 0 {
+		s.timer += (2048 - int(s.freq)) * 4
+		s.pos = (s.pos + 1) & 7
+	}
+}
+
+func (s *square) trigger() {
+	s.enabled = s.env.dac()
+	if s.length.counter == 0 {
+		s.length.counter = 64
+	}
+	s.timer = (2048 - int(s.freq)) * 4
+	s.env.trigger()
+
+	s.shadow = s.freq
+	s.sweepTimer = s.sweepPeriod
+	if s.sweepTimer == 0 {
+		s.sweepTimer = 8
+	}
+	s.sweepOn = s.sweepPeriod != 0 || s.sweepShift != 0
+	if s.sweepShift != 0 {
+		s.sweep()
+	}
+}
+
+// sweep calculates the next frequency and disables the channel on overflow
+func (s *square) sweep() uint16 {
+	f := s.shadow >> s.sweepShift
+	if s.sweepNeg {
+		f = s.shadow - f
+	} else {
+		f = s.shadow + f
+	}
+
+	if f > 2047 {
+		s.enabled = false
+	}
+	return f
+}
+
+func (s *square) clockSweep() {
+	s.sweepTimer--
+	if s.sweepTimer != 0 {
+		return
+	}
+
+	s.sweepTimer = s.sweepPeriod
+	if s.sweepTimer == 0 {
+		s.sweepTimer = 8
+	}
+
+	if s.sweepOn && s.sweepPeriod != 0 {
+		f := s.sweep()
+		if f <= 2047 && s.sweepShift != 0 {
+			s.shadow = f
+			s.freq = f
+			s.sweep()
+		}
+	}
+}
+
+func (s *square) output() byte {
+	if !s.enabled {
+		return 0
+	}
+	return dutyTable[s.duty][s.pos] * s.env.volume
+}
+
+type wave struct {
+	enabled bool
+	dacOn   bool
+	length  length
+
+	volume byte
+	freq   uint16
+	timer  int
+	pos    byte
+	sample byte
+	ram    [16]byte
+}
+
+func (w *wave) step(cycles int) {
+	w.timer -= cycles
+	for w.timer <= 0 {
+		w.timer += (2048 - int(w.freq)) * 2
+		w.pos = (w.pos + 1) & 31
+		w.sample = w.ram[w.pos>>1]
+		if w.pos&1 == 0 {
+			w.sample >>= 4
+		}
+		w.sample &= 0x0f
+	}
+}
+
+func (w *wave) trigger() {
+	w.enabled = w.dacOn
+	if w.length.counter == 0 {
+		w.length.counter = 256
+	}
+	w.timer = (2048 - int(w.freq)) * 2
+	w.pos = 0
+}
+
+func (w *wave) output() byte {
+	if !w.enabled {
+		return 0
+	}
+	return w.sample >> waveShift[w.volume]
+}
+
+type noise struct {
+	enabled bool
+	length  length
+	env     envelope
+
+	shift   byte
+	width7  bool
+	divisor byte
+	timer   int
+	lfsr    uint16
+}
+
+func (n *noise) period() int {
+	return noiseDivisors[n.divisor] << n.shift
+}
+
+func (n *noise) step(cycles int) {
+	n.timer -= cycles
+	for n.timer <= 0 {
+		n.timer += n.period()
+
+		x := (n.lfsr ^ n.lfsr>>1) & 1
+		n.lfsr = n.lfsr>>1 | x<<14
+		if n.width7 {
+			n.lfsr = n.lfsr&^0x40 | x<<6
+		}
+	}
+}
+
+func (n *noise) trigger() {
+	n.enabled = n.env.dac()
+	if n.length.counter == 0 {
+		n.length.counter = 64
+	}
+	n.timer = n.period()
+	n.env.trigger()
+	n.lfsr = 0x7fff
+}
+
+func (n *noise) output() byte {
+	if !n.enabled || n.lfsr&1 != 0 {
+		return 0
+	}
+	return n.env.volume
+}
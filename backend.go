@@ -0,0 +1,96 @@
+package main
+
+const (
+	ScreenWidth  = 160
+	ScreenHeight = 144
+
+	// Super Game Boy output including the border
+	SGBWidth  = 256
+	SGBHeight = 224
+)
+
+// Video receives every finished frame as 32-bit pixels, 4 bytes per pixel.
+// The size is the LCD's, or the SGB's when running with its border.
+type Video interface {
+	Present(pixels []byte, width, height int)
+	Close()
+}
+
+// Input hands host events to the emulator, it is polled once per frame.
+type Input interface {
+	Poll() []Event
+	Close()
+}
+
+// Audio takes interleaved stereo samples.
+type Audio interface {
+	Queue(samples []int16)
+	Close()
+}
+
+// Fullscreener is implemented by windowed video backends.
+type Fullscreener interface {
+	ToggleFullscreen()
+}
+
+type VideoConfig struct {
+	Scale      int // initial window size as multiple of 160x144, 1-8
+	Fullscreen bool
+	Letterbox  bool // keep the aspect ratio instead of whole number scaling
+}
+
+type Backend struct {
+	Video Video
+	Input Input
+	Audio Audio
+}
+
+func (b Backend) Close() {
+	b.Audio.Close()
+	b.Input.Close()
+	b.Video.Close()
+}
+
+type EventType byte
+
+const (
+	EventQuit EventType = iota
+	EventKeyDown
+	EventKeyUp
+)
+
+// Key uses the lower case ascii code for printable keys, everything else
+// is listed below.
+type Key int
+
+const (
+	KeyEnter     Key = 13
+	KeyBackspace Key = 8
+	KeyTab       Key = 9
+	KeyEscape    Key = 27
+	KeySpace     Key = 32
+
+	KeyUp Key = 0x100 + iota
+	KeyDown
+	KeyLeft
+	KeyRight
+	KeyShift
+	KeyF1
+	KeyF2
+	KeyF3
+	KeyF4
+	KeyF5
+	KeyF6
+	KeyF7
+	KeyF8
+	KeyF9
+	KeyF10
+	KeyF11
+	KeyF12
+)
+
+type Event struct {
+	Type  EventType
+	Key   Key
+	Shift bool
+}
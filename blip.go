@@ -0,0 +1,71 @@
+package main
+
+import "math"
+
+// Band-limited step synthesis: every change of a channel's level is added as
+// a windowed sinc impulse at its exact sub-sample time and the buffer is
+// integrated on the way out, which avoids the aliasing of point sampling.
+const (
+	blipPhases = 32
+	blipWidth  = 16
+	blipSize   = 64 // ring buffer, power of two
+	blipCutoff = 0.9
+)
+
+var blipKernel = makeBlipKernel()
+
+func makeBlipKernel() (k [blipPhases][blipWidth]float32) {
+	for p := 0; p < blipPhases; p++ {
+		var taps [blipWidth]float64
+		var sum float64
+
+		for i := range taps {
+			x := float64(i) - float64(p)/blipPhases - blipWidth/2
+
+			y := math.Pi * blipCutoff * x
+			sinc := 1.0
+			if y != 0 {
+				sinc = math.Sin(y) / y
+			}
+			// blackman window
+			w := 0.42 + 0.5*math.Cos(2*math.Pi*x/blipWidth) + 0.08*math.Cos(4*math.Pi*x/blipWidth)
+
+			taps[i] = sinc * w
+			sum += taps[i]
+		}
+
+		for i := range taps {
+			k[p][i] = float32(taps[i] / sum)
+		}
+	}
+	return
+}
+
+type blip struct {
+	buf   [blipSize]float32
+	pos   int
+	sum   float32
+	level float32
+}
+
+// set changes the level at t output samples after the next one to be read.
+func (b *blip) set(t float64, level float32) {
+	d := level - b.level
+	if d == 0 {
+		return
+	}
+	b.level = level
+
+	i := int(t)
+	phase := int((t - float64(i)) * blipPhases)
+	for k, v := range blipKernel[phase] {
+		b.buf[(b.pos+i+k)&(blipSize-1)] += d * v
+	}
+}
+
+func (b *blip) read() float32 {
+	b.sum += b.buf[b.pos]
+	b.buf[b.pos] = 0
+	b.pos = (b.pos + 1) & (blipSize - 1)
+	return b.sum
+}
@@ -0,0 +1,169 @@
+package main
+
+import "fmt"
+
+type Model int
+
+const (
+	ModelAuto Model = iota // CGB for Color cartridges, DMG otherwise
+	ModelDMG
+	ModelCGB
+	ModelSGB
+)
+
+func ParseModel(s string) (Model, error) {
+	switch s {
+	case "auto":
+		return ModelAuto, nil
+	case "dmg":
+		return ModelDMG, nil
+	case "cgb":
+		return ModelCGB, nil
+	case "sgb":
+		return ModelSGB, nil
+	}
+	return ModelAuto, fmt.Errorf("unknown model %q, use auto, dmg, cgb or sgb", s)
+}
+
+// SetModel picks the hardware to emulate, it takes effect with the next
+// reset.
+func (c *CPU) SetModel(m Model) {
+	c.model = m
+}
+
+// CGB reports whether the Color features are active, a CGB running a
+// monochrome cartridge has them turned off.
+func (c *CPU) CGB() bool {
+	return c.cgb
+}
+
+// detectModel decides between DMG and CGB hardware from the cartridge
+// header.
+func (c *CPU) detectModel() {
+	color := len(c.rom) > 0x143 && c.rom[0x143]&0x80 != 0
+
+	c.sgb = nil
+
+	switch c.model {
+	case ModelDMG:
+		c.hwCGB = false
+	case ModelSGB:
+		c.hwCGB = false
+		c.sgb = NewSGB(c)
+	case ModelCGB:
+		c.hwCGB = true
+	default:
+		c.hwCGB = color
+	}
+
+	// the CGB boot ROM runs in CGB mode and picks the final one with KEY0
+	c.cgb = c.hwCGB && (color || c.bios() != nil)
+}
+
+// bios returns the boot ROM for the current hardware, if one was loaded.
+func (c *CPU) bios() []byte {
+	if c.hwCGB {
+		return c.cgbBoot
+	}
+	return c.boot
+}
+
+// writeKey0 is how the CGB boot ROM switches to DMG compatibility mode.
+func (c *CPU) writeKey0(value byte) {
+	if c.inBios && c.hwCGB {
+		c.cgb = value&0x04 == 0
+	}
+}
+
+// skipBoot sets up the machine the way the boot ROM leaves it.
+func (c *CPU) skipBoot() {
+	r := &c.Register
+	if c.cgb {
+		r.A, r.F = 0x11, 0x80
+		r.B, r.C = 0x00, 0x00
+		r.D, r.E = 0xff, 0x56
+		r.H, r.L = 0x00, 0x0d
+	} else if c.hwCGB {
+		r.A, r.F = 0x11, 0x80
+		r.B, r.C = 0x00, 0x00
+		r.D, r.E = 0x00, 0x08
+		r.H, r.L = 0x00, 0x7c
+	} else if c.sgb != nil {
+		r.A, r.F = 0x01, 0x00
+		r.B, r.C = 0x00, 0x14
+		r.D, r.E = 0x00, 0x00
+		r.H, r.L = 0xc0, 0x60
+	} else {
+		r.A, r.F = 0x01, 0xb0
+		r.B, r.C = 0x00, 0x13
+		r.D, r.E = 0x00, 0xd8
+		r.H, r.L = 0x01, 0x4d
+	}
+	r.SP = 0xfffe
+	r.PC = 0x100
+
+	c.timer.div = 0xabcc
+
+	c.apu.WriteByte(0xff26, 0xf1)
+	c.apu.WriteByte(0xff24, 0x77)
+	c.apu.WriteByte(0xff25, 0xf3)
+
+	c.gpu.WriteByte(0xff40, 0x91)
+	c.gpu.WriteByte(0xff47, 0xfc)
+	c.gpu.WriteByte(0xff48, 0xff)
+	c.gpu.WriteByte(0xff49, 0xff)
+
+	if c.cgb {
+		// all background palettes white
+		for i := range c.gpu.cgbBg {
+			c.gpu.cgbBg[i] = 0xff
+			if i&1 == 1 {
+				c.gpu.cgbBg[i] = 0x7f
+			}
+		}
+	} else if c.hwCGB {
+		c.gpu.setCompatPalettes(c.compatScheme())
+	}
+}
+
+// wramAddr maps 0xC000 - 0xFDFF to the work RAM, 0xD000 is banked by SVBK
+// on CGB and 0xE000 on echoes 0xC000.
+func (c *CPU) wramAddr(addr uint16) int {
+	addr &= 0x1fff
+	if addr < 0x1000 {
+		return int(addr)
+	}
+
+	bank := int(c.svbk & 7)
+	if bank == 0 || !c.cgb {
+		bank = 1
+	}
+	return bank*0x1000 + int(addr&0x0fff)
+}
+
+func (c *CPU) readKey1() byte {
+	if !c.cgb {
+		return 0xff
+	}
+
+	ret := 0x7e | c.key1
+	if c.doubleSpeed {
+		ret |= 0x80
+	}
+	return ret
+}
+
+// stop handles the STOP instruction, on CGB with KEY1 armed it switches
+// between normal and double speed. Low power mode isn't emulated, STOP
+// resets DIV and carries on otherwise.
+func (c *CPU) stop() {
+	c.timer.WriteByte(0xff04, 0)
+
+	if !c.cgb || c.key1 == 0 {
+		return
+	}
+
+	c.doubleSpeed = !c.doubleSpeed
+	c.key1 = 0
+	c.speedSwitch = 2050
+}
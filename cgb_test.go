@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCGBBootOverlay(t *testing.T) {
+	boot := make([]byte, 0x900)
+	for i := range boot {
+		boot[i] = byte(i) ^ 0x5a
+	}
+	path := filepath.Join(t.TempDir(), "cgb_boot.bin")
+	if err := os.WriteFile(path, boot, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCPU(t, ModelCGB)
+	c.LoadBootLoader(path)
+	c.HardReset()
+	if !c.inBios {
+		t.Fatal("boot ROM isn't mapped")
+	}
+
+	// the cartridge header shows through the gap
+	for _, addr := range []uint16{0x0000, 0x00ff, 0x0100, 0x0150, 0x0200, 0x0500, 0x08ff, 0x0900} {
+		want := c.rom[addr]
+		if addr < 0x100 || addr >= 0x200 && addr < 0x900 {
+			want = boot[addr]
+		}
+		if got := c.ReadByte(addr); got != want {
+			t.Errorf("0x%04x reads 0x%02x, want 0x%02x", addr, got, want)
+		}
+	}
+}
+
+// newCGBTestCPU runs a Color cartridge that only spins.
+func newCGBTestCPU(t *testing.T) *CPU {
+	c := NewCPU(NewHeadlessBackend())
+	c.SetModel(ModelCGB)
+	c.LoadROM(programROM(t, true, []byte{0x18, 0xfe}))
+	if !c.cgb {
+		t.Fatal("not in CGB mode")
+	}
+	return c
+}
+
+func TestCGBBanks(t *testing.T) {
+	c := newCGBTestCPU(t)
+
+	// VBK
+	for bank := byte(0); bank < 2; bank++ {
+		c.WriteByte(0xff4f, bank)
+		c.WriteByte(0x8000, 0xa0+bank)
+		c.WriteByte(0x9fff, 0xb0+bank)
+	}
+	for bank := byte(0); bank < 2; bank++ {
+		c.WriteByte(0xff4f, bank)
+		if got := c.ReadByte(0xff4f); got != 0xfe|bank {
+			t.Errorf("VBK reads 0x%02x in bank %d", got, bank)
+		}
+		if got := c.ReadByte(0x8000); got != 0xa0+bank {
+			t.Errorf("0x8000 in VRAM bank %d reads 0x%02x", bank, got)
+		}
+		if got := c.ReadByte(0x9fff); got != 0xb0+bank {
+			t.Errorf("0x9fff in VRAM bank %d reads 0x%02x", bank, got)
+		}
+	}
+
+	// SVBK, bank 0 selects bank 1 and 0xC000 is always bank 0
+	for bank := byte(1); bank < 8; bank++ {
+		c.WriteByte(0xff70, bank)
+		c.WriteByte(0xd000, 0x10+bank)
+		c.WriteByte(0xc000, 0x20+bank)
+	}
+	for bank := byte(0); bank < 8; bank++ {
+		c.WriteByte(0xff70, bank)
+		want := 0x10 + bank
+		if bank == 0 {
+			want = 0x11
+		}
+		if got := c.ReadByte(0xd000); got != want {
+			t.Errorf("0xd000 with SVBK %d reads 0x%02x, want 0x%02x", bank, got, want)
+		}
+		if got := c.ReadByte(0xc000); got != 0x27 {
+			t.Errorf("0xc000 with SVBK %d reads 0x%02x", bank, got)
+		}
+		// the echo follows the banks too
+		if got := c.ReadByte(0xf000); got != want {
+			t.Errorf("0xf000 with SVBK %d reads 0x%02x, want 0x%02x", bank, got, want)
+		}
+	}
+}
+
+func TestCGBPaletteAutoIncrement(t *testing.T) {
+	c := newCGBTestCPU(t)
+
+	for _, tc := range []struct {
+		name      string
+		spec, dat uint16
+		mem       *[64]byte
+	}{
+		{"BCPD", 0xff68, 0xff69, &c.gpu.cgbBg},
+		{"OCPD", 0xff6a, 0xff6b, &c.gpu.cgbObj},
+	} {
+		// from 0x3e on, it wraps around to 0
+		c.WriteByte(tc.spec, 0x80|0x3e)
+		for i := byte(0); i < 4; i++ {
+			c.WriteByte(tc.dat, 0x50+i)
+		}
+		for i, want := range map[int]byte{0x3e: 0x50, 0x3f: 0x51, 0: 0x52, 1: 0x53} {
+			if tc.mem[i] != want {
+				t.Errorf("%s wrote 0x%02x to %d, want 0x%02x", tc.name, tc.mem[i], i, want)
+			}
+		}
+		if got := c.ReadByte(tc.spec); got != 0x80|0x40|0x02 {
+			t.Errorf("%s index reads 0x%02x after the writes", tc.name, got)
+		}
+
+		// without bit 7 it stays put, reading never moves it
+		next := tc.mem[0x11]
+		c.WriteByte(tc.spec, 0x10)
+		c.WriteByte(tc.dat, 0x60)
+		c.WriteByte(tc.dat, 0x61)
+		if got := c.ReadByte(tc.dat); got != 0x61 || tc.mem[0x11] != next {
+			t.Errorf("%s without auto increment reads 0x%02x", tc.name, got)
+		}
+		c.WriteByte(tc.spec, 0x80|0x3e)
+		c.ReadByte(tc.dat)
+		if got := c.ReadByte(tc.spec) & 0x3f; got != 0x3e {
+			t.Errorf("%s index moved to 0x%02x by reading", tc.name, got)
+		}
+	}
+}
+
+func TestCGBBackgroundAttributes(t *testing.T) {
+	c := newCGBTestCPU(t)
+	c.WriteByte(0xff40, 0x93) // objects on
+
+	// every palette color is p*4+c+1 for the background, 0x100 more for
+	// objects
+	c.WriteByte(0xff68, 0x80)
+	c.WriteByte(0xff6a, 0x80)
+	for i := uint16(0); i < 32; i++ {
+		c.WriteByte(0xff69, byte(i+1))
+		c.WriteByte(0xff69, 0)
+		c.WriteByte(0xff6b, byte(i+1))
+		c.WriteByte(0xff6b, 1)
+	}
+
+	// tile 1 has color 1 at the top left in bank 0, color 3 in bank 1,
+	// tile 2 is color 3 everywhere for the objects
+	c.WriteByte(0xff4f, 0)
+	c.WriteByte(0x8010, 0x80)
+	for i := uint16(0); i < 16; i++ {
+		c.WriteByte(0x8020+i, 0xff)
+	}
+	c.WriteByte(0xff4f, 1)
+	c.WriteByte(0x8010, 0x80)
+	c.WriteByte(0x8011, 0x80)
+
+	attrs := []byte{
+		0x00,        // plain
+		0x20,        // x flip
+		0x40,        // y flip
+		0x08 | 0x02, // bank 1, palette 2
+		0x80,        // BG over objects
+		0x00,        // objects over BG
+	}
+	for i, attr := range attrs {
+		c.WriteByte(0xff4f, 0)
+		c.WriteByte(0x9800+uint16(i), 1)
+		c.WriteByte(0xff4f, 1)
+		c.WriteByte(0x9800+uint16(i), attr)
+	}
+
+	for i, x := range []byte{8 + 32, 8 + 40} {
+		c.WriteByte(0xfe00+uint16(i)*4, 16)
+		c.WriteByte(0xfe01+uint16(i)*4, x)
+		c.WriteByte(0xfe02+uint16(i)*4, 2)
+		c.WriteByte(0xfe03+uint16(i)*4, 0)
+	}
+	c.RunFrames(2)
+
+	bg := func(p, c uint16) uint16 { return 0x8000 | (p*4 + c + 1) }
+	obj := func(p, c uint16) uint16 { return 0x8000 | 0x100 | (p*4 + c + 1) }
+	for _, tc := range []struct {
+		name string
+		x, y int
+		want uint16
+	}{
+		{"plain", 0, 0, bg(0, 1)},
+		{"plain", 7, 0, bg(0, 0)},
+		{"x flip", 8, 0, bg(0, 0)},
+		{"x flip", 15, 0, bg(0, 1)},
+		{"y flip", 16, 0, bg(0, 0)},
+		{"y flip", 16, 7, bg(0, 1)},
+		{"bank and palette", 24, 0, bg(2, 3)},
+		{"BG priority", 32, 0, bg(0, 1)},
+		{"BG priority, color 0", 33, 0, obj(0, 3)},
+		{"no BG priority", 40, 0, obj(0, 3)},
+	} {
+		if got := c.gpu.frame[tc.y*ScreenWidth+tc.x]; got != tc.want {
+			t.Errorf("%s: pixel %d,%d is 0x%04x, want 0x%04x", tc.name, tc.x, tc.y, got, tc.want)
+		}
+	}
+}
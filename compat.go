@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Colors the CGB boot ROM gives monochrome cartridges. A licensed Nintendo
+// title gets a palette combination picked by the sum of its title bytes,
+// everything else the default one. Holding a direction and A or B while the
+// logo shows overrides the choice. The tables are the boot ROM's.
+
+// compatColors are the boot ROM's palettes, four RGB555 colors each.
+var compatColors = [...]uint16{
+	0x7fff, 0x32bf, 0x00d0, 0x0000,
+	0x639f, 0x4279, 0x15b0, 0x04cb,
+	0x7fff, 0x6e31, 0x454a, 0x0000,
+	0x7fff, 0x1bef, 0x0200, 0x0000,
+	0x7fff, 0x421f, 0x1cf2, 0x0000,
+	0x7fff, 0x5294, 0x294a, 0x0000,
+	0x7fff, 0x03ff, 0x012f, 0x0000,
+	0x7fff, 0x03ef, 0x01d6, 0x0000,
+	0x7fff, 0x42b5, 0x3dc8, 0x0000,
+	0x7e74, 0x03ff, 0x0180, 0x0000,
+	0x67ff, 0x77ac, 0x1a13, 0x2d6b,
+	0x7ed6, 0x4bff, 0x2175, 0x0000,
+	0x53ff, 0x4a5f, 0x7e52, 0x0000,
+	0x4fff, 0x7ed2, 0x3a4c, 0x1ce0,
+	0x03ed, 0x7fff, 0x255f, 0x0000,
+	0x036a, 0x021f, 0x03ff, 0x7fff,
+	0x7fff, 0x01df, 0x0112, 0x0000,
+	0x231f, 0x035f, 0x00f2, 0x0009,
+	0x7fff, 0x03ea, 0x011f, 0x0000,
+	0x299f, 0x001a, 0x000c, 0x0000,
+	0x7fff, 0x027f, 0x001f, 0x0000,
+	0x7fff, 0x03e0, 0x0206, 0x0120,
+	0x7fff, 0x7eeb, 0x001f, 0x7c00,
+	0x7fff, 0x3fff, 0x7e00, 0x001f,
+	0x7fff, 0x03ff, 0x001f, 0x0000,
+	0x03ff, 0x001f, 0x000c, 0x0000,
+	0x7fff, 0x033f, 0x0193, 0x0000,
+	0x0000, 0x4200, 0x037f, 0x7fff,
+	0x7fff, 0x7e8c, 0x7c00, 0x0000,
+	0x7fff, 0x1bef, 0x6180, 0x0000,
+}
+
+// compatCombinations are OBJ0, OBJ1 and BG of each combination as the
+// index of their first color. Most start at a palette, a few in the middle
+// of one.
+var compatCombinations = [...][3]int{
+	{4 * 4, 4 * 4, 29 * 4},
+	{18 * 4, 18 * 4, 18 * 4},
+	{20 * 4, 20 * 4, 20 * 4},
+	{24 * 4, 24 * 4, 24 * 4},
+	{9 * 4, 9 * 4, 9 * 4},
+	{0 * 4, 0 * 4, 0 * 4},
+	{27 * 4, 27 * 4, 27 * 4},
+	{5 * 4, 5 * 4, 5 * 4},
+	{12 * 4, 12 * 4, 12 * 4},
+	{26 * 4, 26 * 4, 26 * 4},
+	{16 * 4, 8 * 4, 8 * 4}, // 10
+	{4 * 4, 28 * 4, 28 * 4},
+	{4 * 4, 2 * 4, 2 * 4},
+	{3 * 4, 4 * 4, 4 * 4},
+	{4 * 4, 29 * 4, 29 * 4},
+	{28 * 4, 4 * 4, 28 * 4},
+	{2 * 4, 17 * 4, 2 * 4},
+	{16 * 4, 16 * 4, 8 * 4},
+	{4 * 4, 4 * 4, 7 * 4},
+	{4 * 4, 4 * 4, 18 * 4},
+	{4 * 4, 4 * 4, 20 * 4}, // 20
+	{19 * 4, 19 * 4, 9 * 4},
+	{4*4 - 1, 4*4 - 1, 11 * 4},
+	{17 * 4, 17 * 4, 2 * 4},
+	{4 * 4, 4 * 4, 2 * 4},
+	{4 * 4, 4 * 4, 3 * 4},
+	{28 * 4, 28 * 4, 0 * 4},
+	{3 * 4, 3 * 4, 0 * 4},
+	{0 * 4, 0 * 4, 1 * 4},
+	{18 * 4, 22 * 4, 18 * 4},
+	{20 * 4, 22 * 4, 20 * 4}, // 30
+	{24 * 4, 22 * 4, 24 * 4},
+	{16 * 4, 22 * 4, 8 * 4},
+	{17 * 4, 4 * 4, 13 * 4},
+	{28*4 - 1, 0 * 4, 14 * 4},
+	{28*4 - 1, 4 * 4, 15 * 4},
+	{19 * 4, 22 * 4, 9 * 4},
+	{16 * 4, 28 * 4, 10 * 4},
+	{4 * 4, 23 * 4, 28 * 4},
+	{17 * 4, 22 * 4, 2 * 4},
+	{4 * 4, 0 * 4, 2 * 4}, // 40
+	{4 * 4, 28 * 4, 3 * 4},
+	{28 * 4, 3 * 4, 0 * 4},
+	{3 * 4, 28 * 4, 4 * 4},
+	{21 * 4, 28 * 4, 4 * 4},
+	{3 * 4, 28 * 4, 0 * 4},
+	{25 * 4, 3 * 4, 28 * 4},
+	{0 * 4, 28 * 4, 8 * 4},
+	{4 * 4, 3 * 4, 28 * 4},
+	{28 * 4, 3 * 4, 6 * 4},
+	{4 * 4, 28 * 4, 29 * 4}, // 50
+}
+
+func compatCombination(i int) ColorScheme {
+	pal := func(first int) (p Palette) {
+		for j := range p {
+			p[j] = rgb555(compatColors[first+j])
+		}
+		return
+	}
+	c := compatCombinations[i]
+	return ColorScheme{BG: pal(c[2]), OBJ0: pal(c[0]), OBJ1: pal(c[1])}
+}
+
+// compatCombos are the button overrides, the default is right+A.
+var compatCombos = map[Button]ColorScheme{
+	ButtonRight:           compatCombination(1),
+	ButtonLeft:            compatCombination(48),
+	ButtonUp:              compatCombination(5),
+	ButtonDown:            compatCombination(8),
+	ButtonRight | ButtonA: compatCombination(0),
+	ButtonLeft | ButtonA:  compatCombination(40),
+	ButtonUp | ButtonA:    compatCombination(43),
+	ButtonDown | ButtonA:  compatCombination(3),
+	ButtonRight | ButtonB: compatCombination(6),
+	ButtonLeft | ButtonB:  compatCombination(7),
+	ButtonUp | ButtonB:    compatCombination(28),
+	ButtonDown | ButtonB:  compatCombination(49),
+}
+
+var compatDefault = compatCombination(0)
+
+// compatChecksums are the title sums the boot ROM knows. From
+// compatFirstDuplicate on they collide and the fourth letter of the title
+// has to be compatLetters' too.
+var compatChecksums = [...]byte{
+	0x00, 0x88, 0x16, 0x36, 0xd1, 0xdb, 0xf2, 0x3c, 0x8c, 0x92,
+	0x3d, 0x5c, 0x58, 0xc9, 0x3e, 0x70, 0x1d, 0x59, 0x69, 0x19,
+	0x35, 0xa8, 0x14, 0xaa, 0x75, 0x95, 0x99, 0x34, 0x6f, 0x15,
+	0xff, 0x97, 0x4b, 0x90, 0x17, 0x10, 0x39, 0xf7, 0xf6, 0xa2,
+	0x49, 0x4e, 0x43, 0x68, 0xe0, 0x8b, 0xf0, 0xce, 0x0c, 0x29,
+	0xe8, 0xb7, 0x86, 0x9a, 0x52, 0x01, 0x9d, 0x71, 0x9c, 0xbd,
+	0x5d, 0x6d, 0x67, 0x3f, 0x6b,
+
+	0xb3, 0x46, 0x28, 0xa5, 0xc6, 0xd3, 0x27, 0x61, 0x18, 0x66,
+	0x6a, 0xbf, 0x0d, 0xf4, 0xb3, 0x46, 0x28, 0xa5, 0xc6, 0xd3,
+	0x27, 0x61, 0x18, 0x66, 0x6a, 0xbf, 0x0d, 0xf4, 0xb3,
+}
+
+const (
+	compatFirstDuplicate = 65
+	compatLetters        = "BEFAARBEKEK R-URAR INAILICE R"
+)
+
+// compatTitleCombos is the combination for each of compatChecksums.
+var compatTitleCombos = [len(compatChecksums)]byte{
+	0, 4, 5, 35, 34, 3, 31, 15, 10, 5,
+	19, 36, 7, 37, 30, 44, 21, 32, 31, 20,
+	5, 33, 13, 14, 5, 29, 5, 18, 9, 3,
+	2, 26, 25, 25, 41, 42, 26, 45, 42, 45,
+	36, 38, 26, 42, 30, 41, 34, 34, 5, 42,
+	6, 5, 33, 25, 42, 42, 40, 2, 16, 25,
+	42, 42, 5, 0, 39,
+
+	36, 22, 25, 6, 32, 12, 36, 11, 39, 18,
+	39, 24, 31, 50, 17, 46, 6, 27, 0, 47,
+	41, 41, 0, 0, 19, 34, 23, 18, 29,
+}
+
+// compatTitleCombo finds the combination of a licensed title like the boot
+// ROM, 0 when it isn't known.
+func compatTitleCombo(title []byte) int {
+	hash := titleHash(title)
+	for i, h := range compatChecksums {
+		if h != hash {
+			continue
+		}
+		if i < compatFirstDuplicate || compatLetters[i-compatFirstDuplicate] == title[3] {
+			return int(compatTitleCombos[i])
+		}
+	}
+	return 0
+}
+
+func titleHash(title []byte) byte {
+	var sum byte
+	for _, b := range title {
+		sum += b
+	}
+	return sum
+}
+
+var compatComboNames = map[string]Button{
+	"up": ButtonUp, "down": ButtonDown, "left": ButtonLeft, "right": ButtonRight,
+	"a": ButtonA, "b": ButtonB,
+}
+
+// ParseCompatCombo reads a button override like "left+b".
+func ParseCompatCombo(s string) (Button, error) {
+	var b Button
+	for _, part := range strings.Split(strings.ToLower(s), "+") {
+		bit, ok := compatComboNames[part]
+		if !ok {
+			return 0, fmt.Errorf("unknown button %q in %q", part, s)
+		}
+		b |= bit
+	}
+	if _, ok := compatCombos[b]; !ok {
+		return 0, fmt.Errorf("%q is not a palette combination", s)
+	}
+	return b, nil
+}
+
+// SetCompatCombo forces the colors of a DMG cartridge on CGB as if the
+// buttons were held during boot, 0 picks them by title again.
+func (c *CPU) SetCompatCombo(b Button) {
+	c.compatCombo = b
+}
+
+// compatScheme picks the colors the boot ROM would.
+func (c *CPU) compatScheme() ColorScheme {
+	combo := c.compatCombo
+	if combo == 0 {
+		combo = c.joypad.buttons & (ButtonUp | ButtonDown | ButtonLeft | ButtonRight | ButtonA | ButtonB)
+	}
+	if cs, ok := compatCombos[combo]; ok {
+		return cs
+	}
+
+	rom := c.rom
+	nintendo := rom[0x14b] == 0x01 || rom[0x14b] == 0x33 && rom[0x144] == '0' && rom[0x145] == '1'
+	if nintendo {
+		return compatCombination(compatTitleCombo(rom[0x134:0x144]))
+	}
+	return compatDefault
+}
+
+// setCompatPalettes loads cs into the CGB palette memory, BG into palette
+// 0, the two object layers into object palettes 0 and 1.
+func (g *GPU) setCompatPalettes(cs ColorScheme) {
+	for i, p := range []Palette{cs.BG, cs.OBJ0, cs.OBJ1} {
+		dst, base := &g.cgbObj, (i-1)*8
+		if i == 0 {
+			dst, base = &g.cgbBg, 0
+		}
+		for j, col := range p {
+			v := toRGB555(col)
+			dst[base+j*2] = byte(v)
+			dst[base+j*2+1] = byte(v >> 8)
+		}
+	}
+}
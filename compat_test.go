@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestCompatTitleCombo(t *testing.T) {
+	for _, tc := range []struct {
+		title string
+		combo int
+	}{
+		{"POKEMON RED", 13},
+		{"POKEMON BLUE", 11}, // collides with VEGAS STAKES
+		{"VEGAS STAKES", 41},
+		{"TETRIS", 3},
+		{"ZELDA", 44},
+		{"SUPER MARIOLAND", 22},
+		{"POKMEON BLUE", 0}, // same sum, unknown fourth letter
+		{"TESTROM", 0},
+	} {
+		var title [16]byte
+		copy(title[:], tc.title)
+		if got := compatTitleCombo(title[:]); got != tc.combo {
+			t.Errorf("%s gets combination %d, want %d", tc.title, got, tc.combo)
+		}
+	}
+}
+
+func TestCompatScheme(t *testing.T) {
+	c := NewCPU(NewHeadlessBackend())
+	c.SetModel(ModelCGB)
+	c.LoadROM(testROM(t, false))
+
+	// not licensed, so the title doesn't count
+	copy(c.rom[0x134:0x144], "POKEMON RED\x00\x00\x00\x00\x00")
+	if c.compatScheme() != compatDefault {
+		t.Error("unlicensed title didn't get the default colors")
+	}
+	c.rom[0x14b] = 0x01
+	if c.compatScheme() != compatCombination(13) {
+		t.Error("licensed title didn't get its colors")
+	}
+
+	// the overrides, the colors as the boot ROM shows them
+	for _, tc := range []struct {
+		combo string
+		bg    Color
+	}{
+		{"right+a", Color{0x7b, 0xff, 0x31}},
+		{"left+b", Color{0xa5, 0xa5, 0xa5}},
+		{"down", Color{0xff, 0x94, 0x94}},
+		{"up", Color{0xff, 0xad, 0x63}},
+	} {
+		b, err := ParseCompatCombo(tc.combo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetCompatCombo(b)
+		if got := c.compatScheme().BG[1]; got != tc.bg {
+			t.Errorf("%s has BG color %v, want %v", tc.combo, got, tc.bg)
+		}
+	}
+}
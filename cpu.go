@@ -3,7 +3,7 @@ package main
 import (
 	"os"
 	"fmt"
-	"github.com/veandco/go-sdl2/sdl"
+	"time"
 )
 
 type Register struct {
@@ -34,60 +34,111 @@ type MBC struct {
 
 type CPU struct {
 	ram		[]byte
+	wram	[]byte	// 8 banks of 4k, only 2 on DMG
 	rom		[]byte
+	romPath	string
+	boot	[]byte
+	cgbBoot	[]byte
+
+	model	Model
+	hwCGB	bool	// CGB hardware, maybe running a DMG cartridge
+	cgb		bool	// CGB features enabled
+	compatCombo	Button
+	sgb		*SGB	// nil unless running as a Super Game Boy
+	svbk	byte
+
+	doubleSpeed	bool
+	key1		byte	// speed switch armed
+	speedSwitch	uint16	// M-cycles left until the new speed is stable
+	stall		uint16	// M-cycles the CPU waits for a VRAM DMA
 
 	isCB	bool
 
 	gpu		 	*GPU
+	apu			*APU
+	timer		*Timer
+	hdma		*HDMA
+	serial		*Serial
+	joypad		*Joypad
+	backend		Backend
+	colors		ColorScheme
+	correction	ColorCorrection
+	pixels		[]byte
+	screenW		int	// size of the last presented frame
+	screenH		int
+	screenshotScale	int	// for Shift+s
+	gifRecorder	*GIFRecorder
+	videoRecorder	*Y4MRecorder
+	stateSlot	int	// for F5 and F8
+	rewind		*Rewind	// nil without rewinding
+	rewinding	bool
+	movie		*Movie	// being recorded or played
 	Register	Register
 	RSV			Register
 
-	Clock	uint16
+	Clock	uint64	// M-cycles at normal speed
+	dots	uint64	// 4 MHz clocks
+	Pacer	Pacer
 
 	Ie		byte
 	If		byte	// Interrupt flags
 	inBios  bool
+	paused	bool
+	advance	bool
+	breakpoint	bool	// LD B,B was executed
 
-	romoffs uint16
-	ramoffs uint16
+	romoffs uint32
+	ramoffs uint32
 
 	mbc1	MBC
 }
 
-func NewCPU() *CPU {
+func NewCPU(backend Backend) *CPU {
 	cpu := new(CPU)
 
+	cpu.backend = backend
 	cpu.Register.IME = 1
 	cpu.romoffs = 0x4000
 	cpu.mbc1 = MBC{}
 
 	cpu.ram = make([]byte, 65535)
+	cpu.wram = make([]byte, 0x8000)
+	cpu.colors = ColorSchemes["grey"]
+	cpu.pixels = make([]byte, SGBWidth*SGBHeight*4)
+	cpu.screenW, cpu.screenH = ScreenWidth, ScreenHeight
+	cpu.screenshotScale = 1
 	cpu.gpu = NewGPU(cpu)
+	cpu.apu = NewAPU(cpu)
+	cpu.timer = &Timer{cpu: cpu}
+	cpu.hdma = &HDMA{cpu: cpu}
+	cpu.serial = &Serial{cpu: cpu}
+	cpu.joypad = &Joypad{cpu: cpu}
 
 	return cpu
 }
 
 func (c *CPU) LoadROM(file string) {
-	c.rom = make([]byte, 32768)
-
-	f, err := os.Open(file)
+	rom, err := os.ReadFile(file)
 	if err != nil {
 		panic(err)
 	}
-
-	n1, err := f.Read(c.rom)
-	if err != nil {
-		panic(err)
+	if len(rom) < 0x8000 {
+		rom = append(rom, make([]byte, 0x8000-len(rom))...)
 	}
+	c.rom = rom
+	c.romPath = file
+
+	fmt.Printf("Read %d rom\n", len(rom))
 
-	fmt.Printf("Read %d rom\n", n1)
+	c.HardReset()
+	if c.cgb {
+		fmt.Println("Running in CGB mode")
+	}
 }
 
 func (c *CPU) WriteWord(addr uint16, data uint16) {
-	fmt.Printf("Write 16 bits 0x%x to 0x%x\n", data, addr)
-
-	c.ram[addr] = uint8(data & 0xff)
-	c.ram[addr+1] = uint8(data>>8)
+	c.WriteByte(addr, uint8(data & 0xff))
+	c.WriteByte(addr+1, uint8(data>>8))
 }
 
 func (c *CPU) WriteByte(addr uint16, data byte) {
@@ -109,16 +160,16 @@ func (c *CPU) WriteByte(addr uint16, data byte) {
 			data = 1
 		}
 		c.mbc1.rombank |= data
-		c.romoffs = uint16(c.mbc1.rombank) * 0x4000
+		c.romoffs = uint32(c.mbc1.rombank) * 0x4000
 		break
 	case 0x4000, 0x5000:
 		if c.mbc1.mode != 0 {
 			c.mbc1.rambank = data&3
-			c.ramoffs = uint16(c.mbc1.rambank) * 0x2000
+			c.ramoffs = uint32(c.mbc1.rambank) * 0x2000
 		} else {
 			c.mbc1.rombank &= 0x1f
 			c.mbc1.rombank |= (data&3) << 5
-			c.romoffs = uint16(c.mbc1.rombank) * 0x4000
+			c.romoffs = uint32(c.mbc1.rombank) * 0x4000
 		}
 		break
 	case 0x6000, 0x7000:
@@ -127,11 +178,14 @@ func (c *CPU) WriteByte(addr uint16, data byte) {
 	case 0x8000, 0x9000:	// vram
 		c.gpu.WriteVram(addr & 0x1fff, data)
 		c.gpu.UpdateTile(addr & 0x1fff, data)
-		break
+		return
+	case 0xc000, 0xd000, 0xe000:
+		c.wram[c.wramAddr(addr)] = data
+		return
 	case 0xf000:
 		switch addr & 0x0f00 {
 		case 0x000, 0x100, 0x200, 0x300, 0x400, 0x500, 0x600, 0x700, 0x800, 0x900, 0xa00, 0xb00, 0xc00, 0xd00:
-			c.ram[addr] = data
+			c.wram[c.wramAddr(addr)] = data
 			return
 		case 0xe00:
 			if (addr&0xFF)<0xA0 {
@@ -144,10 +198,6 @@ func (c *CPU) WriteByte(addr uint16, data byte) {
 				c.Ie = data
 				return
 			} else if addr > 0xFF7F {
-				fmt.Printf("Write 0x%x to 0x%x\n", data, addr)
-				if addr == 0xff85 {
-					sdl.Delay(1000)
-				}
 				c.ram[addr] = data
 				return
 			} else {
@@ -155,9 +205,14 @@ func (c *CPU) WriteByte(addr uint16, data byte) {
 				case 0x00:
 					switch addr & 0xf {
 					case 0:
-						return	// JOYP
-					case 4: case 5: case 6: case 7:
-						return	// Timer
+						c.joypad.Write(data)
+						return
+					case 1, 2:
+						c.serial.WriteByte(addr, data)
+						return
+					case 4, 5, 6, 7:
+						c.timer.WriteByte(addr, data)
+						return
 					case 15:
 						c.If = data
 						return
@@ -165,8 +220,22 @@ func (c *CPU) WriteByte(addr uint16, data byte) {
 						return
 					}
 				case 0x10, 0x20, 0x30:
+					c.apu.WriteByte(addr, data)
 					return
 				case 0x40, 0x50, 0x60, 0x70:
+					if addr == 0xff70 {
+						c.svbk = data & 7
+						return
+					} else if addr == 0xff4d {
+						c.key1 = data & 1
+						return
+					} else if addr == 0xff4c {
+						c.writeKey0(data)
+						return
+					} else if addr >= 0xff51 && addr <= 0xff55 {
+						c.hdma.WriteByte(addr, data)
+						return
+					}
 					c.gpu.WriteByte(addr, data)
 					return
 				}
@@ -186,7 +255,10 @@ func (c *CPU) ReadByte(addr uint16) byte {
 	case 0x0000:
 		if c.inBios {
 			if addr < 0x0100 {
-				return c.ram[addr]
+				return c.bios()[addr]
+			} else if c.hwCGB && addr >= 0x200 && addr < 0x900 {
+				// the CGB boot ROM continues after the cartridge header
+				return c.cgbBoot[addr]
 			} else if c.Register.PC == 0x100 {
 				c.inBios = false
 				fmt.Println("Leave bios/bootloader")
@@ -202,11 +274,15 @@ func (c *CPU) ReadByte(addr uint16) byte {
 		//fmt.Printf("Read rom at 0x%x\n", addr)
 		return c.rom[addr]
 	case 0x4000, 0x5000, 0x6000, 0x7000:
-		return c.rom[c.romoffs+(addr & 0x3fff)]
+		return c.rom[(c.romoffs+uint32(addr & 0x3fff)) % uint32(len(c.rom))]
+	case 0x8000, 0x9000:
+		return c.gpu.ReadVram(addr & 0x1fff)
+	case 0xc000, 0xd000, 0xe000:
+		return c.wram[c.wramAddr(addr)]
 	case 0xf000:
 		switch addr & 0x0f00 {
 		case 0x000, 0x100, 0x200, 0x300, 0x400, 0x500, 0x600, 0x700, 0x800, 0x900, 0xa00, 0xb00, 0xc00, 0xd00:
-			return c.ram[addr]
+			return c.wram[c.wramAddr(addr)]
 		case 0xe00:
 			if addr & 0xff < 0xa0 {
 				return c.gpu.ReadOam(addr & 0xff)
@@ -224,17 +300,29 @@ func (c *CPU) ReadByte(addr uint16) byte {
 				case 0x00:
 					switch addr & 0xf {
 					case 0:
-						return 0	// JOYP
-					case 4: case 5: case 6: case 7:
-						return 0	// Timer
+						return c.joypad.Read()
+					case 1, 2:
+						return c.serial.ReadByte(addr)
+					case 4, 5, 6, 7:
+						return c.timer.ReadByte(addr)
 					case 15:
 						return c.If
 					default:
 						return 0
 					}
 				case 0x10, 0x20, 0x30:
-					return 0
+					return c.apu.ReadByte(addr)
 				case 0x40, 0x50, 0x60, 0x70:
+					if addr == 0xff70 {
+						if c.cgb {
+							return 0xf8 | c.svbk
+						}
+						return 0xff
+					} else if addr == 0xff4d {
+						return c.readKey1()
+					} else if addr >= 0xff51 && addr <= 0xff55 {
+						return c.hdma.ReadByte(addr)
+					}
 					return c.gpu.ReadByte(addr)
 				}
 			}
@@ -245,78 +333,279 @@ func (c *CPU) ReadByte(addr uint16) byte {
 }
 
 func (c *CPU) LoadBootLoader(file string) {
-	f, err := os.Open("boot.gb")
+	f, err := os.Open(file)
 	if err != nil {
 		panic(err)
 	}
 
-	n1, err := f.Read(c.ram)
+	boot := make([]byte, 0x1000)
+	n1, err := f.Read(boot)
 	if err != nil {
 		panic(err)
 	}
 
-	if n1 != 256 {
-		panic(fmt.Errorf("BootLoader is not 256 byte long, is %d long", n1))
+	// DMG boot ROMs are 256 bytes, CGB ones 2304 with a gap for the header
+	switch n1 {
+	case 0x100:
+		c.boot = boot[:n1]
+	case 0x900:
+		c.cgbBoot = boot[:n1]
+	default:
+		panic(fmt.Errorf("BootLoader is not 256 or 2304 byte long, is %d long", n1))
 	}
 
-	c.inBios = true
+	c.inBios = c.bios() != nil
 }
 
-func (c *CPU) Run() {
-	c.Register.PC = 0
+// Run is the interactive main loop, it honors pause and frame advance and
+// returns once the emulator is stopped or after the given number of frames.
+func (c *CPU) Run(frames int) {
+	end := c.gpu.frames + frames
 
-	for {
-		code := c.ReadByte(c.Register.PC)
-
-		var opcode Opcode
-		var ok bool
+	for c.gpu.IsRunning() {
+		if frames > 0 && c.gpu.frames >= end {
+			return
+		}
 
-		if c.isCB {
-			opcode, ok = OpcodesCB[code]
-			c.isCB = false
+		if c.rewinding {
+			c.rewindFrame()
+			continue
+		}
 
-			if !ok {
-				fmt.Printf("Unknown cb-opcode 0x%x at 0x%x\n", code, c.Register.PC)
-				return
-			}
-		} else {
-			opcode, ok = Opcodes[code]
+		if c.paused && !c.advance {
+			c.idle()
+			continue
+		}
 
-			if !ok {
-				fmt.Printf("Unknown opcode 0x%x at 0x%x\n", code, c.Register.PC)
-				return
-			}
+		c.movieFrame()
+		if !c.RunFrames(1) {
+			return
 		}
+	}
+}
+
+// RunFrames runs until n more frames have been drawn, n <= 0 runs until the
+// emulator is stopped. It returns false if emulation stopped early.
+func (c *CPU) RunFrames(n int) bool {
+	end := c.gpu.frames + n
 
-		if c.Register.PC >= 0xe9 {
-			//fmt.Printf("Opcode is %s at 0x%x\n", opcode.Mnemonic, c.Register.PC)
-			//return
+	for c.gpu.IsRunning() {
+		if n > 0 && c.gpu.frames >= end {
+			return true
 		}
 
-		data := make([]byte, opcode.Length)
-		end := c.Register.PC + uint16(opcode.Length)
-		i := 0
-		for c.Register.PC < end {
-			data[i] = c.ReadByte(c.Register.PC)
-			c.Register.PC++
-			i++
+		if !c.Step() {
+			return false
 		}
+	}
 
-		if opcode.Callback != nil {
-			opcode.Callback(c, data)
+	return false
+}
 
-			c.Clock += uint16(c.Register.M)
-		} else {
-			fmt.Println("Not implemented!")
-		}
+// idle keeps the frontend responsive while paused.
+func (c *CPU) idle() {
+	for _, e := range c.backend.Input.Poll() {
+		c.handleEvent(e)
+	}
+
+	time.Sleep(time.Second / 60)
+}
+
+// Step executes a single instruction, it returns false on an unknown opcode.
+func (c *CPU) Step() bool {
+	if c.speedSwitch > 0 {
+		// the CPU and DIV stand still while the clock settles
+		c.speedSwitch--
+		c.tick(4, false)
+		return true
+	}
+	if c.stall > 0 {
+		c.stall--
+		c.tick(4, true)
+		return true
+	}
+
+	code := c.ReadByte(c.Register.PC)
+
+	var opcode Opcode
+	var ok bool
+
+	if c.isCB {
+		opcode, ok = OpcodesCB[code]
+		c.isCB = false
 
-		// GPU action
-		c.gpu.CheckLine()
+		if !ok {
+			fmt.Printf("Unknown cb-opcode 0x%x at 0x%x\n", code, c.Register.PC)
+			return false
+		}
+	} else {
+		opcode, ok = Opcodes[code]
 
-		if !c.gpu.IsRunning() {
-			break
+		if !ok {
+			fmt.Printf("Unknown opcode 0x%x at 0x%x\n", code, c.Register.PC)
+			return false
 		}
 	}
+
+	data := make([]byte, opcode.Length)
+	end := c.Register.PC + uint16(opcode.Length)
+	i := 0
+	for c.Register.PC < end {
+		data[i] = c.ReadByte(c.Register.PC)
+		c.Register.PC++
+		i++
+	}
+
+	if opcode.Callback != nil {
+		opcode.Callback(c, data)
+	} else {
+		fmt.Println("Not implemented!")
+		c.Register.M = 0
+	}
+
+	c.tick(uint16(c.Register.M) * 4, true)
+
+	return true
+}
+
+// tick runs the rest of the machine for the clocks the CPU just spent, in
+// double speed mode they only take half as long.
+func (c *CPU) tick(cycles uint16, timer bool) {
+	t := cycles
+	if c.doubleSpeed {
+		t /= 2
+	}
+	c.dots += uint64(t)
+	c.Clock = c.dots / 4
+
+	c.Pacer.Sync(c.Clock, c.backend.Audio)
+
+	// DIV, TIMA and the serial clock run off the CPU clock
+	if timer {
+		c.timer.Tick(cycles)
+		c.serial.Tick(cycles)
+	}
+	c.apu.Tick(t)
+
+	// GPU action
+	c.gpu.CheckLine(t)
+}
+
+// endFrame is called by the GPU when it enters VBlank.
+func (c *CPU) endFrame() {
+	c.advance = false
+
+	if c.sgb != nil {
+		c.sgb.endFrame()
+	}
+	c.present()
+	c.recordFrame()
+	c.apu.flush()
+	c.snapshot()
+
+	for _, e := range c.backend.Input.Poll() {
+		c.handleEvent(e)
+	}
+}
+
+func (c *CPU) present() {
+	if c.sgb != nil {
+		pixels := c.pixels[:SGBWidth*SGBHeight*4]
+		c.colors.Render(c.sgb.render(c.gpu.frame), pixels, CorrectionNone)
+		c.screenW, c.screenH = SGBWidth, SGBHeight
+		c.backend.Video.Present(pixels, SGBWidth, SGBHeight)
+		return
+	}
+
+	pixels := c.pixels[:ScreenWidth*ScreenHeight*4]
+	c.colors.Render(c.gpu.frame, pixels, c.correction)
+	c.screenW, c.screenH = ScreenWidth, ScreenHeight
+	c.backend.Video.Present(pixels, ScreenWidth, ScreenHeight)
+}
+
+func (c *CPU) ColorScheme() ColorScheme {
+	return c.colors
+}
+
+// SetColorCorrection changes how CGB colors are shown.
+func (c *CPU) SetColorCorrection(cc ColorCorrection) {
+	c.correction = cc
+	c.present()
+}
+
+// SetColorScheme changes the colors, the current frame is shown again with
+// the new ones right away.
+func (c *CPU) SetColorScheme(cs ColorScheme) {
+	c.colors = cs
+	c.present()
+}
+
+// Stop makes Run return after the current instruction.
+func (c *CPU) Stop() {
+	c.gpu.running = false
+}
+
+func (c *CPU) Pause() {
+	c.paused = true
+}
+
+func (c *CPU) Resume() {
+	c.paused = false
+	c.advance = false
+}
+
+func (c *CPU) Paused() bool {
+	return c.paused
+}
+
+// AdvanceFrame pauses and lets Run emulate one more frame.
+func (c *CPU) AdvanceFrame() {
+	c.paused = true
+	c.advance = true
+}
+
+// SoftReset restarts the loaded cartridge through the boot ROM, work RAM
+// keeps its contents.
+func (c *CPU) SoftReset() {
+	c.Register = Register{IME: 1}
+	c.RSV = Register{}
+	c.isCB = false
+	c.Ie = 0
+	c.If = 0
+
+	c.romoffs = 0x4000
+	c.ramoffs = 0
+	c.mbc1 = MBC{}
+	c.svbk = 0
+	c.doubleSpeed = false
+	c.key1 = 0
+	c.speedSwitch = 0
+	c.stall = 0
+	c.detectModel()
+
+	c.gpu.reset()
+	c.apu.reset()
+	*c.timer = Timer{cpu: c}
+	*c.hdma = HDMA{cpu: c}
+	*c.serial = Serial{cpu: c, device: c.serial.device}
+	c.joypad.sel = 0
+
+	c.inBios = c.bios() != nil
+	if !c.inBios {
+		c.skipBoot()
+	}
+}
+
+// HardReset is a power cycle, all RAM is cleared too.
+func (c *CPU) HardReset() {
+	for i := range c.ram {
+		c.ram[i] = 0
+	}
+	for i := range c.wram {
+		c.wram[i] = 0
+	}
+
+	c.SoftReset()
 }
 
 func (c *CPU) ActivateCB() {
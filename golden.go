@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strings"
+)
+
+// Golden frame tests compare the screen against a known good PNG, or the
+// SHA-1 of its pixels, e.g. for dmg-acid2 and cgb-acid2.
+
+// FrameImage returns the last presented frame, with the SGB border if
+// there is one.
+func (c *CPU) FrameImage() *image.RGBA {
+	w, h := c.screenW, c.screenH
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < w*h; i++ {
+		// pixels are B, G, R, A
+		img.Pix[i*4+0] = c.pixels[i*4+2]
+		img.Pix[i*4+1] = c.pixels[i*4+1]
+		img.Pix[i*4+2] = c.pixels[i*4+0]
+		img.Pix[i*4+3] = 0xff
+	}
+	return img
+}
+
+// FrameHash is the hex SHA-1 of the last frame's RGBA pixels.
+func (c *CPU) FrameHash() string {
+	sum := sha1.Sum(c.FrameImage().Pix)
+	return hex.EncodeToString(sum[:])
+}
+
+// RunUntilBreakpoint runs whole frames until LD B,B was executed, at most
+// maxFrames. It returns false if the breakpoint wasn't hit.
+func (c *CPU) RunUntilBreakpoint(maxFrames int) bool {
+	c.breakpoint = false
+	for i := 0; i < maxFrames; i++ {
+		if !c.RunFrames(1) {
+			return false
+		}
+		if c.breakpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// CompareImages counts the pixels that differ. The diff image shows the
+// matching ones faded and the others in red, it is nil if the sizes
+// differ.
+func CompareImages(actual, expected image.Image) (*image.RGBA, int) {
+	b := actual.Bounds()
+	if b.Size() != expected.Bounds().Size() {
+		return nil, b.Dx() * b.Dy()
+	}
+	eb := expected.Bounds()
+
+	diff := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	mismatches := 0
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			ar, ag, ab, _ := actual.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			er, eg, eb2, _ := expected.At(eb.Min.X+x, eb.Min.Y+y).RGBA()
+			if ar>>8 != er>>8 || ag>>8 != eg>>8 || ab>>8 != eb2>>8 {
+				mismatches++
+				diff.Set(x, y, color.RGBA{0xff, 0, 0, 0xff})
+				continue
+			}
+			grey := byte((ar>>8+ag>>8+ab>>8)/3/4 + 0xc0)
+			diff.Set(x, y, color.RGBA{grey, grey, grey, 0xff})
+		}
+	}
+	return diff, mismatches
+}
+
+// CheckGolden compares the frame against ref, a PNG file or a SHA-1 from
+// FrameHash. On a PNG mismatch out-actual.png, out-expected.png and
+// out-diff.png are written.
+func (c *CPU) CheckGolden(ref, out string) (bool, error) {
+	if !strings.HasSuffix(strings.ToLower(ref), ".png") {
+		hash := c.FrameHash()
+		if hash != strings.ToLower(ref) {
+			fmt.Printf("Frame hash is %s\n", hash)
+			return false, nil
+		}
+		return true, nil
+	}
+
+	f, err := os.Open(ref)
+	if err != nil {
+		return false, err
+	}
+	expected, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+
+	actual := c.FrameImage()
+	diff, mismatches := CompareImages(actual, expected)
+	if mismatches == 0 {
+		return true, nil
+	}
+
+	if diff == nil {
+		fmt.Printf("Frame is %v, reference %v\n", actual.Bounds().Size(), expected.Bounds().Size())
+	} else {
+		fmt.Printf("%d pixels differ\n", mismatches)
+	}
+
+	if err := writePNG(out+"-actual.png", actual); err != nil {
+		return false, err
+	}
+	if err := writePNG(out+"-expected.png", expected); err != nil {
+		return false, err
+	}
+	if diff != nil {
+		if err := writePNG(out+"-diff.png", diff); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func writePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -1,9 +1,8 @@
 package main
 
 import (
-	"github.com/veandco/go-sdl2/sdl"
 	//"fmt"
-	"fmt"
+	"sort"
 )
 
 type ObjData struct {
@@ -13,46 +12,54 @@ type ObjData struct {
 	palette bool
 	xflip	bool
 	yflip	bool
-	prio	bool
+	prio	bool	// behind background colors 1-3
 	num		byte
+	bank	byte	// CGB only
+	cgbpal	byte
 }
 
 type GPU struct {
 	cpu		*CPU
 
 	running	bool
-	window	*sdl.Window
-	surface	*sdl.Surface
+	frames	int
 
 	reg         []byte
 	oam         []byte
-	vram		[]byte
+	vram		[]byte	// two banks of 8k on CGB
+	vbk			byte
 	paletteBg   []byte
 	paletteObj0 []byte
 	paletteObj1 []byte
 
-	tilemap [512][8][8]byte
-	scanrow [161]byte
+	// CGB color palettes, 8 palettes of 4 RGB555 colors each
+	cgbBg		[64]byte
+	cgbObj		[64]byte
+	bcps		byte
+	ocps		byte
+
+	tilemap [2][512][8][8]byte
 	objdata []ObjData
 
 	modeClocks	uint16
 	lineMode	byte
 	curLine		byte
-	curScan		uint32
 	lcdon		bool
 	bgtilebase	uint16
 	bgmapbase	uint16
+	winmapbase	uint16
+	winon		bool
+	winLine		byte
 	objsize		bool
 	objon		bool
-	bgon		bool
+	bgon		bool	// on CGB this is the BG and window master priority instead
 
 	yscrl		byte
 	xscrl		byte
 	raster		byte
 
-	pixels		[]byte
-
-	debug		bool
+	// layer<<2 | shade per pixel, or 0x8000 | RGB555 on CGB
+	frame		[]uint16
 }
 
 func NewGPU(cpu *CPU) *GPU {
@@ -80,6 +87,12 @@ func (g *GPU) ReadByte(addr uint16) byte {
 		if g.lcdon {
 			ret |= 0x80
 		}
+		if g.winmapbase == 0x1c00 {
+			ret |= 0x40
+		}
+		if g.winon {
+			ret |= 0x20
+		}
 		if g.bgtilebase == 0x0000 {
 			ret |= 0x10
 		}
@@ -110,15 +123,44 @@ func (g *GPU) ReadByte(addr uint16) byte {
 		return g.curLine
 	case 5:
 		return g.raster
+	case 0x0f:
+		if g.cpu.cgb {
+			return 0xfe | g.vbk
+		}
+		return 0xff
+	case 0x28:
+		if g.cpu.cgb {
+			return 0x40 | g.bcps
+		}
+		return 0xff
+	case 0x29:
+		if g.cpu.cgb {
+			return g.cgbBg[g.bcps&0x3f]
+		}
+		return 0xff
+	case 0x2a:
+		if g.cpu.cgb {
+			return 0x40 | g.ocps
+		}
+		return 0xff
+	case 0x2b:
+		if g.cpu.cgb {
+			return g.cgbObj[g.ocps&0x3f]
+		}
+		return 0xff
 	default:
 		return g.reg[gaddr]
 	}
 }
 
+func (g *GPU) ReadVram(addr uint16) byte {
+	return g.vram[uint16(g.vbk)*0x2000+addr]
+}
+
 func (g *GPU) WriteVram(addr uint16, value byte) {
 	//fmt.Printf("Write VRAM 0x%x <- 0x%x\n", addr, value)
 
-	g.vram[addr] = value
+	g.vram[uint16(g.vbk)*0x2000+addr] = value
 }
 
 func (g *GPU) WriteOam(addr uint16, value byte) {
@@ -143,6 +185,12 @@ func (g *GPU) WriteByte(addr uint16, value byte) {
 		} else {
 			g.bgmapbase = 0x1800
 		}
+		if value & 0x40 == 0x40 {
+			g.winmapbase = 0x1c00
+		} else {
+			g.winmapbase = 0x1800
+		}
+		g.winon = value & 0x20 == 0x20
 		g.objsize = value & 0x04 == 0x04
 		g.objon = value & 0x02 == 0x02
 		g.bgon = value & 0x01 == 0x01
@@ -166,55 +214,43 @@ func (g *GPU) WriteByte(addr uint16, value byte) {
 		break
 	case 7:
 		for i := uint16(0); i < 4; i++ {
-			switch (value >> (i*2))&3 {
-			case 0:
-				g.paletteBg[i] = 255
-				break
-			case 1:
-				g.paletteBg[i] = 192
-				break
-			case 2:
-				g.paletteBg[i] = 96
-				break
-			case 3:
-				g.paletteBg[i] = 0
-				break
-			}
+			g.paletteBg[i] = (value >> (i*2))&3
 		}
 		break
 	case 8:
 		for i := uint16(0); i < 4; i++ {
-			switch (value >> (i*2))&3 {
-			case 0:
-				g.paletteObj0[i] = 255
-				break
-			case 1:
-				g.paletteObj0[i] = 192
-				break
-			case 2:
-				g.paletteObj0[i] = 96
-				break
-			case 3:
-				g.paletteObj0[i] = 0
-				break
-			}
+			g.paletteObj0[i] = 4|(value >> (i*2))&3
 		}
 		break
 	case 9:
 		for i := uint16(0); i < 4; i++ {
-			switch (value >> (i*2))&3 {
-			case 0:
-				g.paletteObj1[i] = 255
-				break
-			case 1:
-				g.paletteObj1[i] = 192
-				break
-			case 2:
-				g.paletteObj1[i] = 96
-				break
-			case 3:
-				g.paletteObj1[i] = 0
-				break
+			g.paletteObj1[i] = 8|(value >> (i*2))&3
+		}
+		break
+	case 0x0f:
+		if g.cpu.cgb {
+			g.vbk = value & 1
+		}
+		break
+	case 0x28:
+		g.bcps = value & 0xbf
+		break
+	case 0x29:
+		if g.cpu.cgb {
+			g.cgbBg[g.bcps&0x3f] = value
+			if g.bcps & 0x80 == 0x80 {
+				g.bcps = 0x80 | (g.bcps+1)&0x3f
+			}
+		}
+		break
+	case 0x2a:
+		g.ocps = value & 0xbf
+		break
+	case 0x2b:
+		if g.cpu.cgb {
+			g.cgbObj[g.ocps&0x3f] = value
+			if g.ocps & 0x80 == 0x80 {
+				g.ocps = 0x80 | (g.ocps+1)&0x3f
 			}
 		}
 		break
@@ -222,8 +258,6 @@ func (g *GPU) WriteByte(addr uint16, value byte) {
 }
 
 func (g *GPU) UpdateOam(addr uint16, data byte) {
-	fmt.Println("Update oam")
-
 	addr -= 0xfe00
 
 	obj := addr >> 2
@@ -234,16 +268,15 @@ func (g *GPU) UpdateOam(addr uint16, data byte) {
 			g.objdata[obj].y = int16(data) - 16
 			break
 		case 1:
-			g.objdata[obj].y = int16(data) - 8
+			g.objdata[obj].x = int16(data) - 8
 			break
 		case 2:
-			if g.objsize {
-				g.objdata[obj].tile = data & 0xfe
-			} else {
-				g.objdata[obj].tile = data
-			}
+			g.objdata[obj].tile = data
 			break
 		case 3:
+			g.objdata[obj].bank = (data >> 3) & 1
+			g.objdata[obj].cgbpal = data & 7
+
 			if data & 0x10 == 0x10 {
 				g.objdata[obj].palette = true
 			} else {
@@ -283,6 +316,7 @@ func (g *GPU) UpdateTile(addr uint16, data byte) {
 		saddr--
 		addr--
 	}
+	saddr += uint16(g.vbk)*0x2000
 
 	tile := (addr >> 4) & 511
 	y := (addr >> 1) & 7
@@ -299,71 +333,72 @@ func (g *GPU) UpdateTile(addr uint16, data byte) {
 			s |= 2
 		}
 
-		g.tilemap[tile][y][i] = s
+		g.tilemap[g.vbk][tile][y][i] = s
 	}
 }
 
-func (g *GPU) SetPixel(pixelnum uint32, color byte) {
-	g.pixels[pixelnum+0] = color
-	g.pixels[pixelnum+1] = color
-	g.pixels[pixelnum+2] = color
+func (g *GPU) SetPixel(pixelnum uint32, color uint16) {
+	g.frame[pixelnum] = color
 }
 
-func (g *GPU) CheckLine() {
-	var event sdl.Event
-	for event = sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
-		switch t := event.(type) {
-		case *sdl.QuitEvent:
-			g.running = false
-			break
-		case *sdl.KeyDownEvent:
-			if t.Keysym.Sym == 100 {
-				g.debug = true
-			}
-			fmt.Printf("Key Press %v", t.Keysym.Sym)
-			break
-		}
+// dmgColor turns a layer<<2 | shade value into a frame pixel, a CGB
+// running a DMG cartridge colors the shades with its palettes.
+func (g *GPU) dmgColor(v byte) uint16 {
+	if !g.cpu.hwCGB {
+		return uint16(v)
+	}
+	if v>>2 == 0 {
+		return cgbColor(&g.cgbBg, 0, v&3)
 	}
+	return cgbColor(&g.cgbObj, v>>2-1, v&3)
+}
 
-	g.modeClocks += uint16(g.cpu.Register.M)
+// cgbColor looks up color c of palette p in the CGB palette memory
+func cgbColor(pal *[64]byte, p, c byte) uint16 {
+	i := p*8 + c*2
+	return 0x8000 | (uint16(pal[i]) | uint16(pal[i+1])<<8) & 0x7fff
+}
+
+// CheckLine advances the LCD by the given number of clocks, these are
+// always at the normal 4 MHz rate.
+func (g *GPU) CheckLine(cycles uint16) {
+	g.modeClocks += cycles
 
 	switch g.lineMode {
 	case 0:	// hblank
-		if g.modeClocks >= 51 {
-			if g.curLine == 143 {
+		if g.modeClocks >= 204 {
+			g.curLine++
+			g.modeClocks = 0
+			if g.curLine == 144 {
 				g.lineMode = 1
 				g.cpu.If |= 1
+				g.frames++
+				// last, so states saved at the end of the frame are complete
+				g.cpu.endFrame()
 			} else {
 				g.lineMode = 2
 			}
-			g.curLine++
-			g.curScan += 640
-			g.modeClocks = 0
 		}
 		break
 	case 1: // vblank
-		if g.modeClocks >= 114 {
+		if g.modeClocks >= 456 {
 			g.modeClocks = 0
 			g.curLine++
 			if g.curLine > 153 {
-				if g.debug {
-					sdl.Delay(5000)
-				}
-
 				g.curLine = 0
-				g.curScan = 0
+				g.winLine = 0
 				g.lineMode = 2
 			}
 		}
 		break
 	case 2: // OAM-read
-		if g.modeClocks >= 20 {
+		if g.modeClocks >= 80 {
 			g.modeClocks = 0
 			g.lineMode = 3
 		}
 		break
 	case 3: //VRAM-read
-		if g.modeClocks >= 43 {
+		if g.modeClocks >= 172 {
 			g.modeClocks = 0
 			g.lineMode = 0
 
@@ -371,140 +406,167 @@ func (g *GPU) CheckLine() {
 
 			// read lcd-on flag (at 0xFF40)
 			if g.lcdon {	// lcd is on
-				if g.bgon {
-					linebase := g.curScan
-					mapbase := g.bgmapbase + ((((uint16(g.curLine)+uint16(g.yscrl))&255)>>3)<<5)
-					y := (g.curLine+g.yscrl) & 7
-					x := g.xscrl & 7
-					t := (g.xscrl>>3) & 31
-
-					//var pixel byte
-					w := 160
-
-					if g.bgtilebase != 0 {
-						tile := uint16(g.vram[mapbase+uint16(t)])
-						if tile < 128 {
-							tile += 256
-						}
-
-						tilerow := g.tilemap[tile][y]
-
-						for w > 0 {
-							g.scanrow[160-x] = tilerow[x]
-							color := g.paletteBg[tilerow[x]]
-
-							//fmt.Printf("Write 0x%0x to %v\n", color, linebase+3)
-							g.SetPixel(linebase, color)
-							x++
-							if x == 8 {
-								t = (t+1)&31
-								x = 0
-								tile = uint16(g.vram[mapbase+uint16(t)])
-								if tile < 128 {
-									tile += 256
-								}
-								tilerow = g.tilemap[tile][y]
-							}
-							linebase+=4
-
-							w--
-						}
-					} else {
-						tilerow := g.tilemap[g.vram[mapbase+uint16(t)]][y]
-
-						for w > 0 {
-							g.scanrow[160-x] = tilerow[x]
-							//fmt.Printf("Write 0x%0x to %v\n", g.paletteBg[tilerow[x]], linebase+3)
-							g.SetPixel(linebase, g.paletteBg[tilerow[x]])
-							x++
-							if x == 8 {
-								t = (t+1)&31
-								x = 0
-								tilerow = g.tilemap[g.vram[mapbase+uint16(t)]][y]
-							}
-							linebase += 4
-
-							w--
-						}
-					}
-				}
-				if g.objon {
-					cnt := 0
-					if g.objsize {
-						for i := 0; i < 40; i++ {
-
-						}
-					} else {
-						var tilerow [8]byte
-						var obj ObjData
-						var pal []byte
-						//var x uint8
-						linebase := g.curScan
-
-						for i := 0; i < 40; i++ {
-							obj = g.objdata[i]	// todo change to sorted
-							if obj.y <= int16(g.curLine) && (obj.y+8) > int16(g.curLine) {
-								if obj.yflip {
-									tilerow = g.tilemap[obj.tile][7-(int16(g.curLine)-obj.y)]
-								} else {
-									tilerow = g.tilemap[obj.tile][int16(g.curLine)-obj.y]
-								}
-
-								if obj.palette {
-									pal = g.paletteObj1
-								} else {
-									pal = g.paletteObj0
-								}
-
-								linebase = uint32((int32(g.curLine) * 160 + int32(obj.x))*4)
-								if obj.xflip {
-									for x := int16(0); x < 8; x++ {
-										if obj.x+x >= 0 && obj.x+x < 160 {
-											if tilerow[7-x] != 0 && (obj.prio || g.scanrow[x] == 0) {
-												//fmt.Printf("Write 0x%0x to %v\n", pal[tilerow[7-x]], linebase+3)
-												g.SetPixel(linebase, pal[tilerow[7-x]])
-											}
-										}
-										linebase += 4
-									}
-								} else {
-									for x := int16(0); x < 8; x++ {
-										if obj.x+x >= 0 && obj.x+x < 160 {
-											if tilerow[x] != 0 && (obj.prio || g.scanrow[x] == 0) {
-												//fmt.Printf("Write 0x%0x to %v\n", pal[tilerow[x]], linebase+3)
-												g.SetPixel(linebase, pal[tilerow[x]])
-											}
-										}
-										linebase += 4
-									}
-								}
-								cnt++
-								if cnt > 10 {
-									break
-								}
-							}
-						}
-					}
-				}
+				g.renderLine()
+				g.cpu.hdma.hblankBlock()
 			}
 		}
 		break
 	}
-
-	g.window.UpdateSurface()
 }
 
-func (g *GPU) init() {
-	sdl.Init(sdl.INIT_EVERYTHING)
+// renderLine draws the background, window and objects of the current line.
+func (g *GPU) renderLine() {
+	ly := int(g.curLine)
+	linebase := uint32(ly * ScreenWidth)
+	cgb := g.cpu.cgb
+
+	var bgcolor [ScreenWidth]byte	// color number before the palette, for object priority
+	var bgprio [ScreenWidth]bool	// CGB attribute bit 7
+
+	wx := int(g.reg[0x0b]) - 7
+	wy := int(g.reg[0x0a])
+	window := g.winon && ly >= wy && wx < ScreenWidth && (g.bgon || cgb)
+
+	if g.bgon || cgb {
+		for x := 0; x < ScreenWidth; x++ {
+			var mapaddr uint16
+			var px, py int
+
+			if window && x >= wx {
+				px = x - wx
+				py = int(g.winLine)
+				mapaddr = g.winmapbase
+			} else {
+				px = (x + int(g.xscrl)) & 255
+				py = (ly + int(g.yscrl)) & 255
+				mapaddr = g.bgmapbase
+			}
+			mapaddr += uint16(py>>3)<<5 + uint16(px>>3)
 
-	window, err := sdl.CreateWindow("GoGB", sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED, 160, 144, sdl.WINDOW_SHOWN)
-	if err != nil {
-		panic(err)
+			tile := uint16(g.vram[mapaddr])
+			if g.bgtilebase != 0 && tile < 128 {
+				tile += 256
+			}
+
+			var attr byte
+			if cgb {
+				attr = g.vram[0x2000+mapaddr]
+			}
+
+			row := py & 7
+			if attr & 0x40 == 0x40 {
+				row = 7 - row
+			}
+			col := px & 7
+			if attr & 0x20 == 0x20 {
+				col = 7 - col
+			}
+
+			c := g.tilemap[(attr>>3)&1][tile][row][col]
+			bgcolor[x] = c
+			bgprio[x] = attr & 0x80 == 0x80
+
+			if cgb {
+				g.SetPixel(linebase+uint32(x), cgbColor(&g.cgbBg, attr&7, c))
+			} else {
+				g.SetPixel(linebase+uint32(x), g.dmgColor(g.paletteBg[c]))
+			}
+		}
+
+		if window {
+			g.winLine++
+		}
+	} else {
+		for x := uint32(0); x < ScreenWidth; x++ {
+			g.SetPixel(linebase+x, g.dmgColor(0))
+		}
+	}
+
+	if !g.objon {
+		return
+	}
+
+	height := 8
+	if g.objsize {
+		height = 16
+	}
+
+	// up to 10 objects per line, in OAM order
+	var objs []ObjData
+	for i := 0; i < 40 && len(objs) < 10; i++ {
+		obj := g.objdata[i]
+		if int(obj.y) <= ly && int(obj.y)+height > ly {
+			objs = append(objs, obj)
+		}
+	}
+
+	// on DMG the object with the smaller x coordinate wins, on CGB the
+	// OAM order alone decides
+	if !cgb {
+		sort.SliceStable(objs, func(a, b int) bool {
+			return objs[a].x < objs[b].x
+		})
 	}
 
+	var drawn [ScreenWidth]bool
+	for _, obj := range objs {
+		row := ly - int(obj.y)
+		if obj.yflip {
+			row = height - 1 - row
+		}
+
+		tile := uint16(obj.tile)
+		if height == 16 {
+			tile = (tile & 0xfe) + uint16(row>>3)
+		}
+
+		var bank byte
+		if cgb {
+			bank = obj.bank
+		}
+		tilerow := g.tilemap[bank][tile][row&7]
+
+		for i := 0; i < 8; i++ {
+			x := int(obj.x) + i
+			if x < 0 || x >= ScreenWidth || drawn[x] {
+				continue
+			}
+
+			col := i
+			if obj.xflip {
+				col = 7 - i
+			}
+			c := tilerow[col]
+			if c == 0 {
+				continue
+			}
+			drawn[x] = true
+
+			// with the CGB master priority cleared objects are always on top
+			if bgcolor[x] != 0 && (obj.prio || (cgb && bgprio[x])) && (g.bgon || !cgb) {
+				continue
+			}
+
+			if cgb {
+				g.SetPixel(linebase+uint32(x), cgbColor(&g.cgbObj, obj.cgbpal, c))
+			} else if obj.palette {
+				g.SetPixel(linebase+uint32(x), g.dmgColor(g.paletteObj1[c]))
+			} else {
+				g.SetPixel(linebase+uint32(x), g.dmgColor(g.paletteObj0[c]))
+			}
+		}
+	}
+}
+
+func (g *GPU) reset() {
+	*g = GPU{cpu: g.cpu, running: g.running, frames: g.frames}
+	g.init()
+}
+
+func (g *GPU) init() {
 	g.reg = make([]byte, 64)
 	g.oam = make([]byte, 160)
-	g.vram = make([]byte, 8192)
+	g.vram = make([]byte, 0x4000)
 	g.paletteBg = make([]byte, 4)
 	g.paletteObj0 = make([]byte, 4)
 	g.paletteObj1 = make([]byte, 4)
@@ -515,17 +577,6 @@ func (g *GPU) init() {
 	}
 
 	g.running = true
-	g.window = window
-	surface, err := g.window.GetSurface()
-	if err != nil {
-		panic(err)
-	}
 
-	g.surface = surface
-
-	rect := sdl.Rect{0, 0, 160, 144}
-	g.surface.FillRect(&rect, 0xffffffff)
-
-	g.pixels = g.surface.Pixels()
+	g.frame = make([]uint16, ScreenWidth*ScreenHeight)
 }
-
@@ -0,0 +1,82 @@
+package main
+
+// HDMA copies to VRAM on CGB, either everything at once (general purpose)
+// or 16 bytes per HBlank.
+type HDMA struct {
+	cpu *CPU
+
+	src    uint16
+	dst    uint16
+	blocks byte // 16 byte blocks left, minus one
+	hblank bool // HBlank transfer running
+}
+
+func (h *HDMA) ReadByte(addr uint16) byte {
+	if !h.cpu.cgb || addr != 0xff55 {
+		return 0xff
+	}
+
+	if h.hblank {
+		return h.blocks
+	}
+	return 0x80 | h.blocks
+}
+
+func (h *HDMA) WriteByte(addr uint16, value byte) {
+	if !h.cpu.cgb {
+		return
+	}
+
+	switch addr {
+	case 0xff51:
+		h.src = h.src&0x00ff | uint16(value)<<8
+	case 0xff52:
+		h.src = h.src&0xff00 | uint16(value&0xf0)
+	case 0xff53:
+		h.dst = h.dst&0x00ff | uint16(value&0x1f)<<8
+	case 0xff54:
+		h.dst = h.dst&0xff00 | uint16(value&0xf0)
+	case 0xff55:
+		if h.hblank && value&0x80 == 0 {
+			// pause, HDMA5 keeps the remaining length
+			h.hblank = false
+			return
+		}
+
+		h.blocks = value & 0x7f
+		if value&0x80 != 0 {
+			h.hblank = true
+			return
+		}
+
+		for h.copyBlock() {
+		}
+	}
+}
+
+// copyBlock moves 16 bytes and halts the CPU meanwhile, it returns false
+// after the last one.
+func (h *HDMA) copyBlock() bool {
+	for i := uint16(0); i < 16; i++ {
+		h.cpu.WriteByte(0x8000|(h.dst+i)&0x1fff, h.cpu.ReadByte(h.src+i))
+	}
+	h.src += 16
+	h.dst = (h.dst + 16) & 0x1fff
+
+	// 8 M-cycles at normal speed per block
+	if h.cpu.doubleSpeed {
+		h.cpu.stall += 16
+	} else {
+		h.cpu.stall += 8
+	}
+
+	h.blocks--
+	return h.blocks != 0xff
+}
+
+// hblankBlock is called by the GPU when it enters HBlank.
+func (h *HDMA) hblankBlock() {
+	if h.hblank && !h.copyBlock() {
+		h.hblank = false
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+// The headless backend keeps everything in memory so the emulator can run
+// without a display, e.g. on CI servers or from go test.
+
+type HeadlessVideo struct {
+	Frames int
+	pixels []byte
+	width  int
+	height int
+}
+
+func (v *HeadlessVideo) Present(pixels []byte, width, height int) {
+	if len(v.pixels) != len(pixels) {
+		v.pixels = make([]byte, len(pixels))
+	}
+	copy(v.pixels, pixels)
+	v.width, v.height = width, height
+	v.Frames++
+}
+
+// Size returns the dimensions of the last presented frame.
+func (v *HeadlessVideo) Size() (int, int) {
+	return v.width, v.height
+}
+
+// Pixels returns a copy of the last presented frame.
+func (v *HeadlessVideo) Pixels() []byte {
+	ret := make([]byte, len(v.pixels))
+	copy(ret, v.pixels)
+	return ret
+}
+
+func (v *HeadlessVideo) Close() {
+}
+
+type HeadlessInput struct {
+	events []Event
+}
+
+// Push queues an event for the next poll.
+func (in *HeadlessInput) Push(e Event) {
+	in.events = append(in.events, e)
+}
+
+func (in *HeadlessInput) Poll() []Event {
+	ret := in.events
+	in.events = nil
+	return ret
+}
+
+func (in *HeadlessInput) Close() {
+}
+
+type HeadlessAudio struct {
+	Samples []int16
+	Limit   int // keep at most this many samples, 0 drops everything
+}
+
+func (a *HeadlessAudio) Queue(samples []int16) {
+	if a.Limit == 0 {
+		return
+	}
+	a.Samples = append(a.Samples, samples...)
+	if len(a.Samples) > a.Limit {
+		a.Samples = a.Samples[len(a.Samples)-a.Limit:]
+	}
+}
+
+func (a *HeadlessAudio) Close() {
+}
+
+func NewHeadlessBackend() Backend {
+	return Backend{
+		Video: new(HeadlessVideo),
+		Input: new(HeadlessInput),
+		Audio: new(HeadlessAudio),
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testProgram turns on sound channel 1, fills the tile data and then loops
+// forever bumping 0xC000 into SCX and NR13 and storing JOYP to 0xC001.
+var testProgram = []byte{
+	0x3e, 0x80, 0xe0, 0x26, // NR52 sound on
+	0x3e, 0x77, 0xe0, 0x24, // NR50
+	0x3e, 0xff, 0xe0, 0x25, // NR51
+	0x3e, 0xf3, 0xe0, 0x12, // NR12
+	0x3e, 0x80, 0xe0, 0x11, // NR11
+	0x3e, 0x87, 0xe0, 0x14, // NR14 trigger
+	0x21, 0x00, 0x80, // ld hl,$8000
+	0x7d, 0x22, 0x7c, 0xfe, 0x98, 0x20, 0xf9, // fill until $9800
+	0x3e, 0x10, 0xe0, 0x00, // select the buttons
+	0x21, 0x00, 0xc0, 0x34, 0x7e, // inc ($c000)
+	0xe0, 0x43, 0xe0, 0x13, // SCX, NR13
+	0xf0, 0x00, 0xea, 0x01, 0xc0, // JOYP to $c001
+	0x18, 0xf0, // and again
+}
+
+// testROM writes a 32k ROM running testProgram, cgb sets the Color flag.
+func testROM(t *testing.T, cgb bool) string {
+	return programROM(t, cgb, testProgram)
+}
+
+// programROM writes a 32k ROM that runs program from 0x150.
+func programROM(t *testing.T, cgb bool, program []byte) string {
+	rom := make([]byte, 0x8000)
+	copy(rom[0x100:], []byte{0x00, 0xc3, 0x50, 0x01})
+	copy(rom[0x134:], "TESTROM")
+	if cgb {
+		rom[0x143] = 0x80
+	}
+	rom[0x146] = 0x03 // SGB functions
+	rom[0x14b] = 0x33
+	copy(rom[0x150:], program)
+
+	path := filepath.Join(t.TempDir(), "test.gb")
+	if err := os.WriteFile(path, rom, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestCPU runs the test ROM on a headless emulator without boot ROM.
+func newTestCPU(t *testing.T, model Model) *CPU {
+	c := NewCPU(NewHeadlessBackend())
+	c.SetModel(model)
+	c.LoadROM(testROM(t, model == ModelCGB))
+	return c
+}
+
+func TestHeadlessBackend(t *testing.T) {
+	for _, tc := range []struct {
+		model         Model
+		width, height int
+	}{
+		{ModelDMG, ScreenWidth, ScreenHeight},
+		{ModelCGB, ScreenWidth, ScreenHeight},
+		{ModelSGB, SGBWidth, SGBHeight},
+	} {
+		c := newTestCPU(t, tc.model)
+		video := c.backend.Video.(*HeadlessVideo)
+
+		before := video.Frames
+		if !c.RunFrames(10) {
+			t.Fatalf("model %d stopped early", tc.model)
+		}
+		if n := video.Frames - before; n != 10 {
+			t.Errorf("model %d presented %d frames, want 10", tc.model, n)
+		}
+		if w, h := video.Size(); w != tc.width || h != tc.height {
+			t.Errorf("model %d presented %dx%d, want %dx%d", tc.model, w, h, tc.width, tc.height)
+		}
+		if n := len(video.Pixels()); n != tc.width*tc.height*4 {
+			t.Errorf("model %d has %d bytes of pixels", tc.model, n)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+func (c *CPU) handleEvent(e Event) {
+	switch e.Type {
+	case EventQuit:
+		c.Stop()
+	case EventKeyDown:
+		if b, ok := keyButtons[e.Key]; ok {
+			if c.movie == nil || !c.movie.playing {
+				c.joypad.Press(b)
+			}
+			return
+		}
+
+		switch e.Key {
+		case 'p':
+			if c.Paused() {
+				c.Resume()
+			} else {
+				c.Pause()
+			}
+		case 'n':
+			c.AdvanceFrame()
+		case 'r':
+			if c.movieLocked("reset") {
+				break
+			}
+			if e.Shift {
+				c.HardReset()
+			} else {
+				c.SoftReset()
+			}
+		case 'c':
+			c.nextColorScheme()
+		case 'm':
+			c.apu.SetMuted(!c.apu.Muted())
+		case '-':
+			c.apu.SetVolume(c.apu.Volume() - 0.1)
+		case '=':
+			c.apu.SetVolume(c.apu.Volume() + 0.1)
+		case 'w':
+			c.toggleSoundRecording()
+		case 's':
+			c.takeScreenshot(e.Shift)
+		case 'g':
+			c.toggleGIF()
+		case 'v':
+			c.toggleVideo()
+		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			c.stateSlot = int(e.Key - '0')
+			fmt.Printf("State slot %d\n", c.stateSlot)
+		case KeyF5:
+			c.saveSlot()
+		case KeyF8:
+			c.loadSlot()
+		case 'b':
+			c.setRewinding(true)
+		case KeyTab:
+			if e.Shift {
+				c.Pacer.SetSlowMotion(true)
+			} else {
+				c.Pacer.SetFastForward(true)
+			}
+		case KeyF11:
+			if f, ok := c.backend.Video.(Fullscreener); ok {
+				f.ToggleFullscreen()
+			}
+		}
+	case EventKeyUp:
+		if b, ok := keyButtons[e.Key]; ok {
+			if c.movie == nil || !c.movie.playing {
+				c.joypad.Release(b)
+			}
+			return
+		}
+
+		switch e.Key {
+		case KeyTab:
+			c.Pacer.SetFastForward(false)
+			c.Pacer.SetSlowMotion(false)
+		case 'b':
+			c.setRewinding(false)
+		}
+	}
+}
+
+// nextColorScheme cycles through the preset color schemes.
+func (c *CPU) nextColorScheme() {
+	names := ColorSchemeNames()
+	next := 0
+	for i, name := range names {
+		if ColorSchemes[name] == c.colors {
+			next = (i + 1) % len(names)
+			break
+		}
+	}
+	c.SetColorScheme(ColorSchemes[names[next]])
+}
+
+func (c *CPU) toggleSoundRecording() {
+	if c.apu.Recording() {
+		if err := c.apu.StopRecording(); err != nil {
+			fmt.Printf("Sound recording failed: %v\n", err)
+		}
+		return
+	}
+
+	name := timestamped("wav")
+	if err := c.apu.StartRecording(name, c.apu.recordChannels); err != nil {
+		fmt.Printf("Sound recording failed: %v\n", err)
+		return
+	}
+	fmt.Printf("Recording sound to %s\n", name)
+}
+
+// timestamped returns a file name like gb-20161228-153045.ext, or
+// gb-20161228-153045-2.ext and so on if that second is taken. Any extension
+// counts, a video's WAV goes next to it under the same name.
+func timestamped(ext string) string {
+	base := "gb-" + time.Now().Format("20060102-150405")
+	name := base
+	for n := 2; ; n++ {
+		if taken, _ := filepath.Glob(name + ".*"); len(taken) == 0 {
+			return name + "." + ext
+		}
+		name = fmt.Sprintf("%s-%d", base, n)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+type Button byte
+
+const (
+	ButtonRight Button = 1 << iota
+	ButtonLeft
+	ButtonUp
+	ButtonDown
+	ButtonA
+	ButtonB
+	ButtonSelect
+	ButtonStart
+)
+
+var keyButtons = map[Key]Button{
+	KeyRight:     ButtonRight,
+	KeyLeft:      ButtonLeft,
+	KeyUp:        ButtonUp,
+	KeyDown:      ButtonDown,
+	'x':          ButtonA,
+	'z':          ButtonB,
+	KeyBackspace: ButtonSelect,
+	KeyEnter:     ButtonStart,
+}
+
+type Joypad struct {
+	cpu *CPU
+
+	buttons Button // pressed buttons
+	sel     byte   // P14/P15 as last written
+}
+
+func (j *Joypad) Read() byte {
+	ret := 0xc0 | j.sel | 0x0f
+	if sgb := j.cpu.sgb; sgb != nil && sgb.players > 1 {
+		if j.sel == 0x30 {
+			return 0xf0 | sgb.readPlayer()
+		}
+		if sgb.player != 0 {
+			// nothing is connected to the other controller ports
+			return ret
+		}
+	}
+	if j.sel&0x10 == 0 {
+		ret &^= byte(j.buttons) & 0x0f
+	}
+	if j.sel&0x20 == 0 {
+		ret &^= byte(j.buttons>>4) & 0x0f
+	}
+	return ret
+}
+
+func (j *Joypad) Write(data byte) {
+	j.sel = data & 0x30
+	if j.cpu.sgb != nil {
+		j.cpu.sgb.write(j.sel)
+	}
+}
+
+// SetButtons replaces the pressed buttons, newly pressed ones raise the
+// joypad interrupt.
+func (j *Joypad) SetButtons(b Button) {
+	if b&^j.buttons != 0 {
+		j.cpu.If |= 0x10
+	}
+	j.buttons = b
+}
+
+func (j *Joypad) Buttons() Button {
+	return j.buttons
+}
+
+func (j *Joypad) Press(b Button) {
+	j.SetButtons(j.buttons | b)
+}
+
+func (j *Joypad) Release(b Button) {
+	j.SetButtons(j.buttons &^ b)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// LinkCable connects the serial ports of two emulators over TCP. The side
+// driving the clock sends its byte and waits for the other side's, which
+// answers once its game is waiting on the external clock. That wait keeps
+// both in step for every byte exchanged.
+type LinkCable struct {
+	conn    net.Conn
+	data    chan [2]byte // seq and byte from the other side's master transfers
+	replies chan [2]byte
+	closed  chan struct{}
+	seq     byte
+}
+
+const (
+	linkData   = 1
+	linkReply  = 2
+	linkCancel = 3 // the master gave up on that seq
+
+	// how long a transfer waits for the other side before the byte reads
+	// as 0xFF, like with nothing plugged in
+	linkTimeout = time.Second
+)
+
+// ListenLink waits for another emulator to connect.
+func ListenLink(addr string) (*LinkCable, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	fmt.Printf("Waiting for link cable on %s\n", l.Addr())
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newLinkCable(conn), nil
+}
+
+// DialLink connects to an emulator started with ListenLink.
+func DialLink(addr string) (*LinkCable, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newLinkCable(conn), nil
+}
+
+func newLinkCable(conn net.Conn) *LinkCable {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetNoDelay(true)
+	}
+
+	l := &LinkCable{
+		conn:    conn,
+		data:    make(chan [2]byte, 16),
+		replies: make(chan [2]byte, 16),
+		closed:  make(chan struct{}),
+	}
+	go l.read()
+	return l
+}
+
+func (l *LinkCable) read() {
+	defer close(l.closed)
+
+	var msg [3]byte
+	for {
+		if _, err := io.ReadFull(l.conn, msg[:]); err != nil {
+			return
+		}
+
+		switch msg[0] {
+		case linkData:
+			// keep the newest if the game here never picks them up
+			d := [2]byte{msg[1], msg[2]}
+			select {
+			case l.data <- d:
+			default:
+				<-l.data
+				l.data <- d
+			}
+		case linkReply:
+			l.replies <- [2]byte{msg[1], msg[2]}
+		case linkCancel:
+			// the game here must not pick up a byte the other side
+			// already read as 0xFF
+			for n := len(l.data); n > 0; n-- {
+				select {
+				case d := <-l.data:
+					if d[0] != msg[1] {
+						l.data <- d
+					}
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (l *LinkCable) send(kind, seq, value byte) {
+	l.conn.Write([]byte{kind, seq, value})
+}
+
+func (l *LinkCable) Transfer(out byte) byte {
+	l.seq++
+	l.send(linkData, l.seq, out)
+
+	timeout := time.After(linkTimeout)
+	for {
+		select {
+		case r := <-l.replies:
+			if r[0] == l.seq {
+				return r[1]
+			}
+			// answer to a transfer that already timed out
+		case d := <-l.data:
+			// both sides drive the clock, neither gets anything useful
+			l.send(linkReply, d[0], 0xff)
+		case <-timeout:
+			l.send(linkCancel, l.seq, 0)
+			return 0xff
+		case <-l.closed:
+			return 0xff
+		}
+	}
+}
+
+func (l *LinkCable) Receive(out byte) (byte, bool) {
+	select {
+	case d := <-l.data:
+		l.send(linkReply, d[0], out)
+		return d[1], true
+	default:
+		return 0, false
+	}
+}
+
+func (l *LinkCable) Close() error {
+	return l.conn.Close()
+}
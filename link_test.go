@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func linkPair(t *testing.T) (*LinkCable, *LinkCable) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := <-accepted
+	if other == nil {
+		t.Fatal("no connection")
+	}
+	return newLinkCable(other), newLinkCable(conn)
+}
+
+// receive polls like a game waiting on the external clock.
+func receive(l *LinkCable, out byte) chan byte {
+	got := make(chan byte, 1)
+	go func() {
+		for {
+			if b, ok := l.Receive(out); ok {
+				got <- b
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return got
+}
+
+func TestLinkCableExchange(t *testing.T) {
+	master, slave := linkPair(t)
+	defer master.Close()
+	defer slave.Close()
+
+	exchange := func(out, in byte) {
+		got := receive(slave, in)
+		if b := master.Transfer(out); b != in {
+			t.Errorf("master got 0x%02x, want 0x%02x", b, in)
+		}
+		if b := <-got; b != out {
+			t.Errorf("slave got 0x%02x, want 0x%02x", b, out)
+		}
+	}
+	exchange(0xaa, 0x55)
+
+	// nobody answers, the slave mustn't see that byte later
+	if b := master.Transfer(0x11); b != 0xff {
+		t.Errorf("timed out transfer got 0x%02x", b)
+	}
+	for deadline := time.Now().Add(time.Second); len(slave.data) > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("cancelled byte is still queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	exchange(0x22, 0x66)
+}
@@ -1,18 +1,341 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"strings"
 )
 
 func main() {
 	fmt.Println("GB Emulator v0.1")
 
-	args := os.Args[1:]
+	headless := flag.Bool("headless", false, "run without window, input and sound")
+	frames := flag.Int("frames", 0, "stop after this many frames, 0 runs until quit")
+	serialTest := flag.Bool("serial-test", false, "run a test ROM headless until it prints Passed or Failed over the link port, exit status 0 passed, 1 failed, 3 timed out")
+	mooneye := flag.String("mooneye", "", "run the Mooneye test ROMs in this directory (or file) headless and report each, exit status 1 if any failed")
+	screenshotFrame := flag.Int("screenshot-frame", 0, "save a screenshot after this many frames and exit")
+	screenshot := flag.String("screenshot", "", "file for -screenshot-frame, timestamped by default")
+	screenshotScale := flag.Int("screenshot-scale", 1, "scale factor for -screenshot-frame")
+	golden := flag.String("golden", "", "compare the screen after -frames frames with this PNG or SHA-1, exit status 1 on mismatch")
+	goldenOut := flag.String("golden-out", "golden", "prefix of the actual, expected and diff PNGs written on a -golden mismatch")
+	untilBreakpoint := flag.Bool("until-breakpoint", false, "with -golden, stop at LD B,B instead, -frames is the limit then")
+	rewind := flag.Float64("rewind", 10, "seconds of history kept for rewinding while b is held, 0 turns it off")
+	rewindInterval := flag.Int("rewind-interval", 2, "frames between rewind snapshots")
+	recordMovie := flag.String("record-movie", "", "record the input of every frame from power-on, or -load-state, to this movie file")
+	playMovie := flag.String("play-movie", "", "play back this movie, checking it stays in sync, exit status 1 if it didn't (with -headless it stops at the end)")
+	loadState := flag.String("load-state", "", "start from this save state file")
+	stateCheck := flag.Int("state-check", 0, "after -frames frames save the state, run this many frames from it on two emulators and compare them, exit status 1 if they differ")
+	maxCycles := flag.Uint64("max-cycles", 120*ClockSpeed/4, "M-cycles -serial-test and -mooneye wait for a result")
 
-	cpu := NewCPU()
+	var video VideoConfig
+	flag.IntVar(&video.Scale, "scale", 3, "window scale factor, 1-8")
+	flag.BoolVar(&video.Fullscreen, "fullscreen", false, "start in fullscreen, F11 toggles")
+	flag.BoolVar(&video.Letterbox, "letterbox", false, "scale to fill the window keeping the aspect ratio instead of whole multiples")
+
+	speed := flag.Float64("speed", 1, "emulation speed, 0 is unthrottled (default 0 with -headless)")
+	fastForward := flag.Float64("ff", 0, "speed while Tab is held, 0 is unthrottled")
+	slowMotion := flag.Float64("slowmo", 0.25, "speed while Shift+Tab is held")
+	sync := flag.String("sync", "video", "pace by \"video\" timing or by the \"audio\" queue")
+
+	palette := flag.String("palette", "grey", "color scheme: "+strings.Join(ColorSchemeNames(), ", ")+" or four hex colors like #e0f8d0,#88c070,#346856,#081820, c cycles")
+	paletteBg := flag.String("palette-bg", "", "four hex colors for the background and window")
+	paletteObj0 := flag.String("palette-obj0", "", "four hex colors for sprites using OBP0")
+	paletteObj1 := flag.String("palette-obj1", "", "four hex colors for sprites using OBP1")
+
+	sampleRate := flag.Int("samplerate", 48000, "audio sample rate in Hz")
+	audioMode := flag.String("audio", "accurate", "\"accurate\" band-limited synthesis or \"fast\" point sampling for slow hosts")
+	volume := flag.Float64("volume", 1, "sound volume 0-1, - and = change it")
+	mute := flag.Bool("mute", false, "start muted, m toggles")
+	wav := flag.String("wav", "", "record sound to this WAV file, w toggles recording")
+	wavChannels := flag.Bool("wav-channels", false, "also record each channel to its own WAV file")
+	gifPath := flag.String("gif", "", "record the screen to this animated GIF, g toggles recording")
+	y4m := flag.String("y4m", "", "record uncompressed video to this Y4M file and the sound to a WAV file next to it, v toggles recording")
+
+	model := flag.String("model", "auto", "hardware to emulate: auto, dmg, cgb or sgb (with border)")
+	cgbBoot := flag.String("cgb-boot", "", "CGB boot ROM, Color games start without one otherwise")
+	correction := flag.String("correction", "cgb", "CGB color correction: none, cgb or gba")
+	linkListen := flag.String("link-listen", "", "wait for another emulator to connect a link cable on this address, like :5000")
+	linkConnect := flag.String("link-connect", "", "connect the link cable to an emulator listening on this address")
+	printer := flag.String("printer", "", "connect a Game Boy Printer, printouts are saved as <printer>-001.png and so on")
+	compat := flag.String("compat", "", "colors for DMG games on CGB as if these buttons were held at boot, like up+a")
+	flag.Parse()
+
+	// set instead of calling os.Exit where the deferred cleanup matters
+	status := 0
+	defer func() {
+		if status != 0 {
+			os.Exit(status)
+		}
+	}()
+
+	args := flag.Args()
+	if len(args) < 1 && *mooneye == "" {
+		fmt.Println("Usage: gb [flags] rom.gb")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	m, err := ParseModel(*model)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if *mooneye != "" {
+		results, err := RunMooneyeSuite(*mooneye, m, *maxCycles)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+
+		failed := 0
+		for _, r := range results {
+			fmt.Println(r)
+			if r.Result != TestPassed {
+				failed++
+			}
+		}
+		fmt.Printf("%d of %d passed\n", len(results)-failed, len(results))
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	cc, err := ParseColorCorrection(*correction)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	var combo Button
+	if *compat != "" {
+		if combo, err = ParseCompatCombo(*compat); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+
+	colors, err := ParseColorScheme(*palette)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	for _, p := range []struct {
+		flag string
+		dst  *Palette
+	}{{*paletteBg, &colors.BG}, {*paletteObj0, &colors.OBJ0}, {*paletteObj1, &colors.OBJ1}} {
+		if p.flag == "" {
+			continue
+		}
+		if *p.dst, err = ParsePalette(p.flag); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+
+	if *golden != "" && !*untilBreakpoint && *frames <= 0 {
+		fmt.Println("-golden needs the number of -frames to run")
+		os.Exit(2)
+	}
+
+	if *serialTest || *golden != "" || *stateCheck > 0 {
+		*headless = true
+	}
+
+	var backend Backend
+	if *headless {
+		backend = NewHeadlessBackend()
+	} else {
+		backend, err = NewSDLBackend(video, *sampleRate)
+		if err != nil {
+			panic(err)
+		}
+	}
+	defer backend.Close()
+
+	cpu := NewCPU(backend)
+	cpu.colors = colors
+	cpu.apu.SetSampleRate(*sampleRate)
+	cpu.apu.SetAccurate(*audioMode != "fast")
+	cpu.apu.SetVolume(float32(*volume))
+	cpu.apu.SetMuted(*mute)
+	cpu.apu.recordChannels = *wavChannels
+	if *wav != "" {
+		if err := cpu.apu.StartRecording(*wav, *wavChannels); err != nil {
+			panic(err)
+		}
+	}
+	defer cpu.apu.StopRecording()
+	cpu.Pacer.Speed = *speed
+	if *headless && !isFlagSet("speed") {
+		cpu.Pacer.Speed = 0
+	}
+	cpu.Pacer.FastForward = *fastForward
+	cpu.Pacer.SlowMotion = *slowMotion
+	if *sync == "audio" {
+		cpu.Pacer.Mode = SyncAudio
+	}
+	cpu.screenshotScale = video.Scale
+	cpu.SetModel(m)
+	cpu.SetCompatCombo(combo)
+	cpu.correction = cc
 	cpu.LoadBootLoader("boot.gb")
+	if *cgbBoot != "" {
+		cpu.LoadBootLoader(*cgbBoot)
+	}
 	cpu.LoadROM(args[0])
 
-	cpu.Run()
+	if *gifPath != "" {
+		if err := cpu.StartGIF(*gifPath); err != nil {
+			panic(err)
+		}
+	}
+	defer cpu.StopGIF()
+	if *y4m != "" {
+		if err := cpu.StartVideo(*y4m); err != nil {
+			panic(err)
+		}
+	}
+	defer cpu.StopVideo()
+	if !*headless {
+		cpu.SetRewind(*rewind, *rewindInterval)
+	}
+	if *loadState != "" {
+		if err := cpu.LoadStateFile(*loadState); err != nil {
+			panic(err)
+		}
+	}
+
+	if *stateCheck > 0 {
+		if *frames > 0 {
+			cpu.RunFrames(*frames)
+		}
+		if err := cpu.CheckStateDeterminism(*stateCheck); err != nil {
+			fmt.Println(err)
+			status = 1
+			return
+		}
+		fmt.Println("States match")
+		return
+	}
+
+	if *serialTest {
+		capture := &SerialCapture{Echo: os.Stdout}
+		result := cpu.RunSerialTest(capture, *maxCycles)
+		fmt.Printf("\nTest %v\n", result)
+
+		switch result {
+		case TestPassed:
+		case TestFailed:
+			status = 1
+		default:
+			status = 3
+		}
+		return
+	}
+
+	if *golden != "" {
+		if *untilBreakpoint {
+			limit := *frames
+			if limit <= 0 {
+				limit = 60 * 60
+			}
+			if !cpu.RunUntilBreakpoint(limit) {
+				fmt.Println("No breakpoint")
+			}
+		} else {
+			cpu.RunFrames(*frames)
+		}
+
+		ok, err := cpu.CheckGolden(*golden, *goldenOut)
+		if err != nil {
+			fmt.Println(err)
+			status = 2
+			return
+		}
+		if !ok {
+			fmt.Println("Frame differs")
+			status = 1
+			return
+		}
+		fmt.Println("Frame matches")
+		return
+	}
+
+	if *screenshotFrame > 0 {
+		cpu.Run(*screenshotFrame)
+
+		name := *screenshot
+		if name == "" {
+			name = timestamped("png")
+		}
+		if err := cpu.Screenshot(name, *screenshotScale); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Screenshot saved to %s\n", name)
+		return
+	}
+
+	var link *LinkCable
+	if *linkListen != "" {
+		link, err = ListenLink(*linkListen)
+	} else if *linkConnect != "" {
+		link, err = DialLink(*linkConnect)
+	}
+	if err != nil {
+		panic(err)
+	}
+	if link != nil {
+		defer link.Close()
+		cpu.ConnectSerial(link)
+	}
+	if *printer != "" {
+		if link != nil {
+			fmt.Println("The printer and the link cable can't be used at the same time")
+			status = 2
+			return
+		}
+		p := NewPrinter(*printer)
+		defer p.Close()
+		cpu.ConnectSerial(p)
+	}
+
+	if *recordMovie != "" {
+		if err := cpu.RecordMovie(*recordMovie); err != nil {
+			panic(err)
+		}
+		defer cpu.StopMovie()
+	}
+	if *playMovie != "" {
+		movie, err := cpu.PlayMovie(*playMovie)
+		if err != nil {
+			fmt.Println(err)
+			status = 2
+			return
+		}
+		if *headless && *frames == 0 {
+			*frames = movie.Frames()
+		}
+
+		cpu.Run(*frames)
+		if _, ok := movie.Desync(); ok {
+			status = 1
+		} else {
+			fmt.Println("Movie played back in sync")
+		}
+		return
+	}
+
+	cpu.Run(*frames)
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
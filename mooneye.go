@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Mooneye's test ROMs end with LD B,B, leaving the Fibonacci numbers in
+// the registers when they passed and 0x42 everywhere when they failed.
+
+type MooneyeResult struct {
+	Path   string
+	Result TestResult
+	Reason string // what went wrong unless passed
+}
+
+func (r MooneyeResult) String() string {
+	if r.Result == TestPassed {
+		return "PASS " + r.Path
+	}
+	return fmt.Sprintf("FAIL %s: %s", r.Path, r.Reason)
+}
+
+// RunMooneye runs the loaded ROM until it hits LD B,B or maxCycles
+// M-cycles went by.
+func (c *CPU) RunMooneye(maxCycles uint64) (TestResult, string) {
+	c.breakpoint = false
+
+	start := c.Clock
+	for !c.breakpoint {
+		if c.Clock-start >= maxCycles {
+			return TestTimeout, "no result after " + fmt.Sprint(maxCycles) + " cycles"
+		}
+		if !c.Step() {
+			return TestFailed, fmt.Sprintf("unknown opcode at 0x%x", c.Register.PC)
+		}
+	}
+
+	r := c.Register
+	got := []byte{r.B, r.C, r.D, r.E, r.H, r.L}
+	for i, want := range []byte{3, 5, 8, 13, 21, 34} {
+		if got[i] != want {
+			return TestFailed, fmt.Sprintf("registers B-L are % x", got)
+		}
+	}
+	return TestPassed, ""
+}
+
+// RunMooneyeROM runs one test ROM on a fresh headless emulator.
+func RunMooneyeROM(path string, model Model, maxCycles uint64) (res MooneyeResult) {
+	res.Path = path
+
+	// LoadROM and broken ROMs panic, that's a failed test here
+	defer func() {
+		if err := recover(); err != nil {
+			res.Result = TestFailed
+			res.Reason = fmt.Sprint(err)
+		}
+	}()
+
+	cpu := NewCPU(NewHeadlessBackend())
+	cpu.SetModel(model)
+	cpu.LoadROM(path)
+	res.Result, res.Reason = cpu.RunMooneye(maxCycles)
+	return
+}
+
+// MooneyeROMs lists every .gb file below path, or just path if it is a
+// file, in name order.
+func MooneyeROMs(path string) ([]string, error) {
+	var roms []string
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(p, ".gb") {
+			roms = append(roms, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(roms)
+	return roms, nil
+}
+
+// RunMooneyeSuite runs every ROM MooneyeROMs finds.
+func RunMooneyeSuite(path string, model Model, maxCycles uint64) ([]MooneyeResult, error) {
+	roms, err := MooneyeROMs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []MooneyeResult
+	for _, rom := range roms {
+		results = append(results, RunMooneyeROM(rom, model, maxCycles))
+	}
+	return results, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMooneyeROMs runs the Mooneye test ROMs in $MOONEYE_DIR, the model is
+// $MOONEYE_MODEL or auto.
+func TestMooneyeROMs(t *testing.T) {
+	dir := os.Getenv("MOONEYE_DIR")
+	if dir == "" {
+		t.Skip("MOONEYE_DIR isn't set")
+	}
+	model := ModelAuto
+	if s := os.Getenv("MOONEYE_MODEL"); s != "" {
+		var err error
+		if model, err = ParseModel(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roms, err := MooneyeROMs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roms) == 0 {
+		t.Fatalf("no ROMs in %s", dir)
+	}
+	for _, rom := range roms {
+		name, _ := filepath.Rel(dir, rom)
+		if name == "." {
+			name = filepath.Base(rom)
+		}
+		t.Run(filepath.ToSlash(name), func(t *testing.T) {
+			if r := RunMooneyeROM(rom, model, 120*ClockSpeed/4); r.Result != TestPassed {
+				t.Error(r)
+			}
+		})
+	}
+}
+
+// mooneyeProgram loads B-L and stops at LD B,B like a Mooneye test.
+func mooneyeProgram(b, c, d, e, h, l byte) []byte {
+	return []byte{
+		0x06, b, 0x0e, c, 0x16, d, 0x1e, e, // ld b..e
+		0x3e, h, 0x67, // ld h,a
+		0x2e, l, // ld l
+		0x40,       // ld b,b
+		0x18, 0xfe, // and spin
+	}
+}
+
+func TestRunMooneyeROM(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		program []byte
+		want    TestResult
+	}{
+		{"passed", mooneyeProgram(3, 5, 8, 13, 21, 34), TestPassed},
+		{"failed", mooneyeProgram(0x42, 0x42, 0x42, 0x42, 0x42, 0x42), TestFailed},
+		{"one wrong", mooneyeProgram(3, 5, 8, 13, 21, 0x42), TestFailed},
+		{"timeout", []byte{0x18, 0xfe}, TestTimeout},
+		{"unknown opcode", []byte{0xd3}, TestFailed},
+	} {
+		r := RunMooneyeROM(programROM(t, false, tc.program), ModelDMG, ClockSpeed/4)
+		if r.Result != tc.want {
+			t.Errorf("%s: %v, want %v", tc.name, r, tc.want)
+		}
+		if (r.Reason == "") != (tc.want == TestPassed) {
+			t.Errorf("%s: reason %q", tc.name, r.Reason)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// A movie is "GBMV", the format version, the CRC-32 of the ROM, the model,
+// the save state it starts from, one button byte per frame and the SHA-1 of
+// the machine state every movieHashInterval frames to notice desyncs. The
+// hashes leave out the sound output, it depends on the host. Everything is
+// little endian, lengths are 32 bit.
+const (
+	movieMagic        = "GBMV"
+	movieVersion      = 2
+	movieHashInterval = 60
+)
+
+type Movie struct {
+	rom    uint32
+	model  Model
+	start  []byte
+	inputs []Button
+	hashes [][sha1.Size]byte
+
+	path    string // written there when recording stops
+	playing bool
+	frame   int
+	desync  int // first frame with a different state, -1 for none
+}
+
+func (m *Movie) Frames() int {
+	return len(m.inputs)
+}
+
+// Desync returns the first frame whose state didn't match the recording.
+func (m *Movie) Desync() (int, bool) {
+	return m.desync, m.desync >= 0
+}
+
+func (m *Movie) write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	le := binary.LittleEndian
+	inputs := make([]byte, len(m.inputs))
+	for i, b := range m.inputs {
+		inputs[i] = byte(b)
+	}
+	for _, v := range []interface{}{
+		[]byte(movieMagic), uint16(movieVersion), m.rom, byte(m.model), uint32(movieHashInterval),
+		uint32(len(m.start)), m.start,
+		uint32(len(inputs)), inputs,
+		uint32(len(m.hashes)), m.hashes,
+	} {
+		if err := binary.Write(w, le, v); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func ReadMovie(path string) (*Movie, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	le := binary.LittleEndian
+
+	var magic [4]byte
+	var version uint16
+	var model byte
+	var interval uint32
+	m := &Movie{path: path, desync: -1}
+	if err := binary.Read(r, le, &magic); err != nil || string(magic[:]) != movieMagic {
+		return nil, errors.New("not a movie")
+	}
+	binary.Read(r, le, &version)
+	if version != movieVersion {
+		return nil, fmt.Errorf("movie version %d isn't supported", version)
+	}
+	binary.Read(r, le, &m.rom)
+	binary.Read(r, le, &model)
+	m.model = Model(model)
+	if err := binary.Read(r, le, &interval); err != nil || interval != movieHashInterval {
+		return nil, errors.New("broken movie header")
+	}
+
+	// lengths are checked against the rest of the file before allocating
+	var n uint32
+	if err := binary.Read(r, le, &n); err != nil || int64(n) > int64(r.Len()) {
+		return nil, errors.New("broken movie start state")
+	}
+	m.start = make([]byte, n)
+	io.ReadFull(r, m.start)
+
+	if err := binary.Read(r, le, &n); err != nil || int64(n) > int64(r.Len()) {
+		return nil, errors.New("broken movie input")
+	}
+	inputs := make([]byte, n)
+	io.ReadFull(r, inputs)
+	m.inputs = make([]Button, n)
+	for i, b := range inputs {
+		m.inputs[i] = Button(b)
+	}
+
+	if err := binary.Read(r, le, &n); err != nil || int64(n)*sha1.Size != int64(r.Len()) {
+		return nil, errors.New("broken movie hashes")
+	}
+	m.hashes = make([][sha1.Size]byte, n)
+	binary.Read(r, le, m.hashes)
+	return m, nil
+}
+
+// RecordMovie records the input of every frame Run emulates from the
+// current state on, until StopMovie.
+func (c *CPU) RecordMovie(path string) error {
+	c.StopMovie()
+
+	start, err := c.SaveState()
+	if err != nil {
+		return err
+	}
+	c.movie = &Movie{rom: crc32.ChecksumIEEE(c.rom), model: c.model, start: start, path: path, desync: -1}
+	return nil
+}
+
+// PlayMovie loads the movie's start state and replaces the joypad with its
+// input while Run emulates it.
+func (c *CPU) PlayMovie(path string) (*Movie, error) {
+	c.StopMovie()
+
+	m, err := ReadMovie(path)
+	if err != nil {
+		return nil, err
+	}
+	if m.rom != crc32.ChecksumIEEE(c.rom) {
+		return nil, errors.New("movie was recorded with a different ROM")
+	}
+
+	c.SetModel(m.model)
+	if err := c.LoadState(m.start); err != nil {
+		return nil, err
+	}
+	if c.inBios && c.bios() == nil {
+		return nil, errors.New("movie starts in the boot ROM, it has to be loaded")
+	}
+	m.playing = true
+	c.movie = m
+	return m, nil
+}
+
+// StopMovie ends playback, or recording and writes the movie.
+func (c *CPU) StopMovie() error {
+	m := c.movie
+	if m == nil {
+		return nil
+	}
+	c.movie = nil
+
+	if m.playing {
+		return nil
+	}
+	if err := m.write(m.path); err != nil {
+		return err
+	}
+	fmt.Printf("Movie with %d frames saved to %s\n", len(m.inputs), m.path)
+	return nil
+}
+
+// movieFrame is called by Run before every frame.
+func (c *CPU) movieFrame() {
+	m := c.movie
+	if m == nil {
+		return
+	}
+	if m.playing && m.frame >= len(m.inputs) {
+		fmt.Printf("Movie finished after %d frames\n", m.frame)
+		c.movie = nil
+		return
+	}
+
+	if m.frame%movieHashInterval == 0 {
+		state, err := c.machineState()
+		if err != nil {
+			panic(err)
+		}
+		sum := sha1.Sum(state)
+
+		i := m.frame / movieHashInterval
+		if !m.playing {
+			m.hashes = append(m.hashes, sum)
+		} else if i < len(m.hashes) && m.hashes[i] != sum && m.desync < 0 {
+			m.desync = m.frame
+			fmt.Printf("Movie desynced at frame %d\n", m.frame)
+		}
+	}
+
+	if m.playing {
+		c.joypad.SetButtons(m.inputs[m.frame])
+	} else {
+		m.inputs = append(m.inputs, c.joypad.Buttons())
+	}
+	m.frame++
+}
+
+// movieLocked refuses what would break the running movie.
+func (c *CPU) movieLocked(what string) bool {
+	if c.movie == nil {
+		return false
+	}
+	fmt.Printf("Can't %s during a movie\n", what)
+	return true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// The sound output follows the host, a movie recorded under rate control
+// plays back without it.
+func TestMovieRateControl(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.gbm")
+
+	c := newTestCPU(t, ModelDMG)
+	c.apu.SetSampleRate(48000)
+	c.apu.ratio = 0.995
+	c.RunFrames(5)
+	if err := c.RecordMovie(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		c.joypad.SetButtons(Button(i / 7))
+		c.Run(1)
+	}
+	if err := c.StopMovie(); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := c.machineState()
+
+	p := c.twin()
+	p.apu.SetSampleRate(44100)
+	p.apu.ratio = 1
+	m, err := p.PlayMovie(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Run(m.Frames())
+	if frame, ok := m.Desync(); ok {
+		t.Fatalf("movie desynced at frame %d", frame)
+	}
+	if got, _ := p.machineState(); !bytes.Equal(got, want) {
+		t.Error("machine state differs after playing the movie")
+	}
+}
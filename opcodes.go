@@ -1,7 +1,5 @@
 package main
 
-import "fmt"
-
 type OpcodeFunction func(*CPU, []byte)
 
 type Opcode struct {
@@ -22,6 +20,7 @@ var Opcodes = map[uint8]Opcode {
 	0x0c: {Mnemonic: "INC C",		Length: 1, Duration: 4,		Callback: inc_c},
 	0x0d: {Mnemonic: "DEC C",		Length: 1, Duration: 4,		Callback: dec_c},
 	0x0e: {Mnemonic: "LD C,d8",		Length: 2, Duration: 8,		Callback: ld_c_n},
+	0x10: {Mnemonic: "STOP 0",		Length: 2, Duration: 4,		Callback: stop},
 	0x11: {Mnemonic: "LD DE,d16",	Length: 3, Duration: 12,	Callback: ld_de_nn},
 	0x12: {Mnemonic: "LD (DE),A",	Length: 1, Duration: 8,		Callback: ld_de_a},
 	0x13: {Mnemonic: "INC DE",		Length: 1, Duration: 8, 	Callback: inc_de},
@@ -53,6 +52,7 @@ var Opcodes = map[uint8]Opcode {
 	0x36: {Mnemonic: "LD (HL),d8", 	Length: 2, Duration: 12,	Callback: ld_hl_d},
 	0x3d: {Mnemonic: "DEC A",		Length: 1, Duration: 4,		Callback: dec_a},
 	0x3e: {Mnemonic: "LD A,d8",		Length: 2, Duration: 8,		Callback: ld_a_n},
+	0x40: {Mnemonic: "LD B,B",		Length: 1, Duration: 4,		Callback: ld_b_b},
 	0x47: {Mnemonic: "LD B,A",		Length: 1, Duration: 4, 	Callback: ld_b_a},
 	0x4f: {Mnemonic: "LD C,A",		Length: 1, Duration: 4,		Callback: ld_c_a},
 	0x56: {Mnemonic: "LD D,(HL)",	Length: 1, Duration: 8,		Callback: ld_d_hl},
@@ -117,6 +117,11 @@ func nop(cpu *CPU, data []byte) {
 	cpu.Register.M = 1
 }
 
+func stop(cpu *CPU, data []byte) {
+	cpu.Register.M = 1
+	cpu.stop()
+}
+
 func ld_bc_dd(cpu *CPU, data []byte) {
 	cpu.Register.C = data[1]
 	cpu.Register.B = data[2]
@@ -152,6 +157,12 @@ func dec_b(cpu *CPU, data []byte) {
 	}
 }
 
+// LD B,B does nothing, test ROMs use it as a breakpoint
+func ld_b_b(cpu *CPU, data []byte) {
+	cpu.Register.M = 1
+	cpu.breakpoint = true
+}
+
 func ld_b_n(cpu *CPU, data []byte) {
 	cpu.Register.B = data[1]
 	cpu.Register.M = 2
@@ -760,8 +771,6 @@ func cp_hl(cpu *CPU, data []byte) {
 	addr := (uint16(cpu.Register.H) << 8) + uint16(cpu.Register.L)
 	m := cpu.ReadByte(addr)
 
-	fmt.Printf("Compare 0x%x with 0x%x (located at 0x%x)\n", i, m, addr)
-
 	i -= uint16(m)
 
 	if i < 0 {
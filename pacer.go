@@ -0,0 +1,105 @@
+package main
+
+import "time"
+
+const (
+	ClockSpeed     = 4194304 // Hz
+	CyclesPerFrame = 70224
+
+	// FrameRate is about 59.73 Hz.
+	FrameRate = float64(ClockSpeed) / CyclesPerFrame
+)
+
+// audioLatency is how much sound is kept queued ahead of the speakers.
+const audioLatency = 50 * time.Millisecond
+
+type SyncMode byte
+
+const (
+	SyncVideo SyncMode = iota // sleep until the wall clock catches up
+	SyncAudio                 // block while the audio queue is full
+)
+
+// AudioSyncer is implemented by audio backends that know how much sound is
+// still waiting to be played.
+type AudioSyncer interface {
+	Buffered() time.Duration
+}
+
+// Pacer keeps emulation at real time speed. The zero value does not throttle
+// at all.
+type Pacer struct {
+	Speed       float64 // 1 is real time, 0 is unthrottled
+	FastForward float64 // speed while fast-forwarding, 0 is unthrottled
+	SlowMotion  float64 // speed in slow motion
+	Mode        SyncMode
+
+	fast bool
+	slow bool
+
+	next       uint64 // clock of the next sync
+	start      time.Time
+	startClock uint64
+}
+
+// Sync is called after every instruction with the CPU clock in machine
+// cycles and sleeps once per frame's worth of cycles.
+func (p *Pacer) Sync(clock uint64, audio Audio) {
+	if clock < p.next {
+		return
+	}
+	p.next = clock + CyclesPerFrame/4
+
+	speed := p.speed()
+	if speed == 0 {
+		p.reset(clock)
+		return
+	}
+
+	if s, ok := audio.(AudioSyncer); ok && p.Mode == SyncAudio && speed == 1 {
+		for s.Buffered() > audioLatency {
+			time.Sleep(time.Millisecond)
+		}
+		p.reset(clock)
+		return
+	}
+
+	if p.start.IsZero() {
+		p.reset(clock)
+		return
+	}
+
+	emulated := time.Duration(float64(clock-p.startClock) * 4 / ClockSpeed / speed * float64(time.Second))
+	elapsed := time.Since(p.start)
+	if emulated > elapsed {
+		time.Sleep(emulated - elapsed)
+	} else if elapsed-emulated > 100*time.Millisecond {
+		// too far behind, don't try to catch up
+		p.reset(clock)
+	}
+}
+
+func (p *Pacer) speed() float64 {
+	if p.fast {
+		return p.FastForward
+	}
+	if p.slow {
+		return p.SlowMotion
+	}
+	return p.Speed
+}
+
+func (p *Pacer) reset(clock uint64) {
+	p.start = time.Now()
+	p.startClock = clock
+}
+
+func (p *Pacer) SetFastForward(on bool) {
+	p.fast = on
+	p.start = time.Time{}
+}
+
+func (p *Pacer) SetSlowMotion(on bool) {
+	p.slow = on
+	p.start = time.Time{}
+}
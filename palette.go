@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Color struct {
+	R, G, B byte
+}
+
+// Palette holds the four DMG shades of one layer, lightest first.
+type Palette [4]Color
+
+type ColorScheme struct {
+	BG   Palette
+	OBJ0 Palette
+	OBJ1 Palette
+}
+
+func scheme(p Palette) ColorScheme {
+	return ColorScheme{BG: p, OBJ0: p, OBJ1: p}
+}
+
+var ColorSchemes = map[string]ColorScheme{
+	"grey":   scheme(Palette{{255, 255, 255}, {192, 192, 192}, {96, 96, 96}, {0, 0, 0}}),
+	"dmg":    scheme(Palette{{0x9b, 0xbc, 0x0f}, {0x8b, 0xac, 0x0f}, {0x30, 0x62, 0x30}, {0x0f, 0x38, 0x0f}}),
+	"pocket": scheme(Palette{{0xc4, 0xcf, 0xa1}, {0x8b, 0x95, 0x6d}, {0x4d, 0x53, 0x3c}, {0x1f, 0x1f, 0x1f}}),
+	"bgb":    scheme(Palette{{0xe0, 0xf8, 0xd0}, {0x88, 0xc0, 0x70}, {0x34, 0x68, 0x56}, {0x08, 0x18, 0x20}}),
+}
+
+// ColorSchemeNames returns the preset names in a fixed order.
+func ColorSchemeNames() []string {
+	var names []string
+	for name := range ColorSchemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParsePalette reads four comma separated hex colors like
+// "#e0f8d0,#88c070,#346856,#081820", lightest first.
+func ParsePalette(s string) (Palette, error) {
+	var p Palette
+
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return p, fmt.Errorf("palette needs 4 colors, got %d", len(parts))
+	}
+
+	for i, part := range parts {
+		part = strings.TrimPrefix(strings.TrimSpace(part), "#")
+		if len(part) != 6 {
+			return p, fmt.Errorf("invalid color %q", parts[i])
+		}
+		v, err := strconv.ParseUint(part, 16, 32)
+		if err != nil {
+			return p, fmt.Errorf("invalid color %q", parts[i])
+		}
+		p[i] = Color{R: byte(v >> 16), G: byte(v >> 8), B: byte(v)}
+	}
+
+	return p, nil
+}
+
+// ParseColorScheme accepts a preset name or a palette for all layers.
+func ParseColorScheme(s string) (ColorScheme, error) {
+	if cs, ok := ColorSchemes[s]; ok {
+		return cs, nil
+	}
+
+	p, err := ParsePalette(s)
+	if err != nil {
+		return ColorScheme{}, fmt.Errorf("unknown palette %q: %v", s, err)
+	}
+	return scheme(p), nil
+}
+
+// Render converts a frame of layer<<2 | shade values into 32 bit pixels,
+// values with bit 15 set are CGB RGB555 colors and bypass the scheme.
+func (cs *ColorScheme) Render(frame []uint16, pixels []byte, cc ColorCorrection) {
+	layers := [3]*Palette{&cs.BG, &cs.OBJ0, &cs.OBJ1}
+	lut := cc.table()
+
+	for i, v := range frame {
+		var c Color
+		if v&0x8000 != 0 {
+			c = lut[v&0x7fff]
+		} else {
+			c = layers[(v>>2)%3][v&3]
+		}
+		pixels[i*4+0] = c.B
+		pixels[i*4+1] = c.G
+		pixels[i*4+2] = c.R
+		pixels[i*4+3] = 0xff
+	}
+}
+
+// rgb555 expands a CGB color to 8 bits per channel.
+func rgb555(v uint16) Color {
+	r := byte(v & 0x1f)
+	g := byte(v >> 5 & 0x1f)
+	b := byte(v >> 10 & 0x1f)
+	return Color{r<<3 | r>>2, g<<3 | g>>2, b<<3 | b>>2}
+}
+
+// toRGB555 is the reverse of rgb555.
+func toRGB555(c Color) uint16 {
+	return uint16(c.R>>3) | uint16(c.G>>3)<<5 | uint16(c.B>>3)<<10
+}
+
+// ColorCorrection maps raw CGB colors to what the handheld's LCD shows,
+// its colors are washed out and bleed into each other.
+type ColorCorrection int
+
+const (
+	CorrectionNone ColorCorrection = iota
+	CorrectionCGB
+	CorrectionGBA // a GBA playing CGB games, darker screen
+)
+
+var correctionNames = []string{"none", "cgb", "gba"}
+
+func ParseColorCorrection(s string) (ColorCorrection, error) {
+	for i, name := range correctionNames {
+		if s == name {
+			return ColorCorrection(i), nil
+		}
+	}
+	return CorrectionNone, fmt.Errorf("unknown color correction %q, use %s", s, strings.Join(correctionNames, ", "))
+}
+
+func (cc ColorCorrection) String() string {
+	return correctionNames[cc]
+}
+
+var correctionTables [3]*[0x8000]Color
+
+// table returns the lookup table for all 32768 colors, built on first use.
+func (cc ColorCorrection) table() *[0x8000]Color {
+	if t := correctionTables[cc]; t != nil {
+		return t
+	}
+
+	t := new([0x8000]Color)
+	for v := range t {
+		t[v] = cc.correct(uint16(v))
+	}
+	correctionTables[cc] = t
+	return t
+}
+
+func (cc ColorCorrection) correct(v uint16) Color {
+	r := int(v & 0x1f)
+	g := int(v >> 5 & 0x1f)
+	b := int(v >> 10 & 0x1f)
+
+	switch cc {
+	case CorrectionCGB:
+		// channel mixing as measured on a CGB screen
+		mix := func(x int) byte {
+			if x > 960 {
+				x = 960
+			}
+			return byte(x >> 2)
+		}
+		return Color{mix(r*26 + g*4 + b*2), mix(g*24 + b*8), mix(r*6 + g*4 + b*22)}
+	case CorrectionGBA:
+		// the GBA LCD has a steeper gamma and a bit less bleeding
+		lr := math.Pow(float64(r)/31, 3.5)
+		lg := math.Pow(float64(g)/31, 3.5)
+		lb := math.Pow(float64(b)/31, 3.5)
+		out := func(x float64) byte {
+			x = math.Pow(math.Max(0, math.Min(1, x*0.94)), 1/2.2)
+			return byte(x*255 + 0.5)
+		}
+		return Color{
+			out(0.80*lr + 0.275*lg - 0.075*lb),
+			out(0.135*lr + 0.64*lg + 0.225*lb),
+			out(0.195*lr + 0.155*lg + 0.65*lb),
+		}
+	}
+	return rgb555(v)
+}
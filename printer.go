@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Printer is a Game Boy Printer on the serial port. Every packet is
+//
+//	0x88 0x33 command compression length(2) data checksum(2) 0x00 0x00
+//
+// and the printer answers the last two bytes with 0x81 and its status.
+const (
+	printerInit   = 0x01
+	printerPrint  = 0x02
+	printerData   = 0x04
+	printerStatus = 0x0f
+)
+
+// status bits
+const (
+	printerChecksumError = 0x01
+	printerBusy          = 0x02
+	printerFull          = 0x04
+	printerUnprocessed   = 0x08
+)
+
+// two rows of 20 tiles per data packet, at most 9 of them
+const (
+	printerRowBytes = 20 * 16 * 2
+	printerMaxData  = printerRowBytes * 9
+)
+
+var printerShades = [4]byte{0xff, 0xaa, 0x55, 0x00}
+
+// a unit of margin feeds the paper by a row of tiles
+const printerFeedLines = 8
+
+type Printer struct {
+	prefix string // files are named prefix-001.png and so on
+	Files  []string
+
+	// packet being received
+	pos      int
+	cmd      byte
+	compress bool
+	length   int
+	packet   []byte
+	checksum uint16
+	sum      uint16
+
+	status byte
+	busy   int // status polls until the print is done
+
+	data  []byte   // decoded tile data
+	image [][]byte // lines of the printout so far, one shade per pixel
+}
+
+func NewPrinter(prefix string) *Printer {
+	return &Printer{prefix: prefix}
+}
+
+func (p *Printer) Transfer(out byte) byte {
+	pos := p.pos
+	p.pos++
+
+	switch {
+	case pos == 0:
+		if out != 0x88 {
+			p.pos = 0
+		}
+	case pos == 1:
+		if out != 0x33 {
+			p.pos = 0
+		}
+	case pos == 2:
+		p.cmd = out
+		p.sum = uint16(out)
+	case pos == 3:
+		p.compress = out&1 != 0
+		p.sum += uint16(out)
+	case pos == 4:
+		p.length = int(out)
+		p.sum += uint16(out)
+	case pos == 5:
+		p.length |= int(out) << 8
+		p.sum += uint16(out)
+		p.packet = p.packet[:0]
+	case pos < 6+p.length:
+		p.packet = append(p.packet, out)
+		p.sum += uint16(out)
+	case pos == 6+p.length:
+		p.checksum = uint16(out)
+	case pos == 7+p.length:
+		p.checksum |= uint16(out) << 8
+	case pos == 8+p.length:
+		return 0x81
+	default:
+		// last byte, the command runs and the status goes back
+		p.pos = 0
+		p.command()
+		return p.status
+	}
+	return 0x00
+}
+
+func (p *Printer) Receive(out byte) (byte, bool) {
+	// the printer never drives the clock
+	return 0, false
+}
+
+func (p *Printer) command() {
+	if p.checksum != p.sum {
+		p.status |= printerChecksumError
+		return
+	}
+	p.status &^= printerChecksumError
+
+	switch p.cmd {
+	case printerInit:
+		p.data = p.data[:0]
+		p.status = 0
+		p.busy = 0
+
+	case printerData:
+		if p.compress {
+			p.data = append(p.data, decompressPrinter(p.packet)...)
+		} else {
+			p.data = append(p.data, p.packet...)
+		}
+		if len(p.data) > printerMaxData {
+			p.data = p.data[:printerMaxData]
+		}
+		if len(p.data) > 0 {
+			p.status |= printerUnprocessed
+		}
+		if len(p.data) == printerMaxData {
+			p.status |= printerFull
+		}
+
+	case printerPrint:
+		if len(p.packet) < 4 {
+			return
+		}
+		p.print(p.packet[1], p.packet[2], p.packet[3])
+		p.data = p.data[:0]
+		p.status &^= printerUnprocessed | printerFull
+		p.status |= printerBusy
+		p.busy = 3
+
+	case printerStatus:
+		if p.busy > 0 {
+			if p.busy--; p.busy == 0 {
+				p.status &^= printerBusy
+			}
+		}
+	}
+}
+
+// decompressPrinter undoes the run length encoding of DATA packets, a
+// control byte with bit 7 repeats the next byte (c&0x7f)+2 times, without
+// it c+1 literal bytes follow.
+func decompressPrinter(in []byte) []byte {
+	var out []byte
+	for i := 0; i < len(in); {
+		c := in[i]
+		i++
+		if c&0x80 != 0 {
+			if i >= len(in) {
+				break
+			}
+			for n := int(c&0x7f) + 2; n > 0; n-- {
+				out = append(out, in[i])
+			}
+			i++
+		} else {
+			n := int(c) + 1
+			if i+n > len(in) {
+				n = len(in) - i
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+		}
+	}
+	return out
+}
+
+// print adds the buffered data to the printout. margins holds the feed
+// before in the upper and after in the lower nibble, it comes out as blank
+// paper. A page without a margin after it is continued by the next print.
+func (p *Printer) print(margins, palette, exposure byte) {
+	// exposure 0x40 is normal, lower is lighter and higher darker
+	darken := (int(exposure&0x7f) - 0x40) / 2
+	// games that leave the palette at 0 get the usual one
+	if palette == 0 {
+		palette = 0xe4
+	}
+
+	p.feed(int(margins >> 4))
+
+	rows := len(p.data) / (20 * 16)
+	for row := 0; row < rows; row++ {
+		for y := 0; y < 8; y++ {
+			line := make([]byte, 160)
+			for tx := 0; tx < 20; tx++ {
+				tile := p.data[(row*20+tx)*16:]
+				lo, hi := tile[y*2], tile[y*2+1]
+				for x := 0; x < 8; x++ {
+					bit := byte(0x80) >> uint(x)
+					c := 0
+					if lo&bit != 0 {
+						c |= 1
+					}
+					if hi&bit != 0 {
+						c |= 2
+					}
+					shade := int(printerShades[(palette>>uint(c*2))&3]) - darken
+					if shade < 0 {
+						shade = 0
+					} else if shade > 255 {
+						shade = 255
+					}
+					line[tx*8+x] = byte(shade)
+				}
+			}
+			p.image = append(p.image, line)
+		}
+	}
+
+	if margins&0x0f != 0 {
+		p.feed(int(margins & 0x0f))
+		if err := p.save(); err != nil {
+			fmt.Printf("Can't save printout: %v\n", err)
+		}
+	}
+}
+
+func (p *Printer) feed(units int) {
+	for i := 0; i < units*printerFeedLines; i++ {
+		line := make([]byte, 160)
+		for x := range line {
+			line[x] = printerShades[0]
+		}
+		p.image = append(p.image, line)
+	}
+}
+
+// save writes the printout so far to the next file.
+func (p *Printer) save() error {
+	if len(p.image) == 0 {
+		return nil
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 160, len(p.image)))
+	for y, line := range p.image {
+		for x, v := range line {
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	p.image = nil
+
+	path := fmt.Sprintf("%s-%03d.png", p.prefix, len(p.Files)+1)
+	if err := writePNG(path, img); err != nil {
+		return err
+	}
+
+	fmt.Printf("Printed %s\n", path)
+	p.Files = append(p.Files, path)
+	return nil
+}
+
+// Close saves a printout that is still waiting for its final page.
+func (p *Printer) Close() error {
+	return p.save()
+}
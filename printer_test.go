@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecompressPrinter(t *testing.T) {
+	for _, tc := range []struct {
+		in, want []byte
+	}{
+		{nil, nil},
+		{[]byte{0x02, 1, 2, 3}, []byte{1, 2, 3}},
+		{[]byte{0x81, 0xaa}, []byte{0xaa, 0xaa, 0xaa}},
+		{[]byte{0x80, 0x55, 0x00, 7}, []byte{0x55, 0x55, 7}},
+		{[]byte{0x03, 1, 2}, []byte{1, 2}}, // cut short
+		{[]byte{0x85}, nil},
+	} {
+		if got := decompressPrinter(tc.in); !bytes.Equal(got, tc.want) {
+			t.Errorf("% x decompresses to % x, want % x", tc.in, got, tc.want)
+		}
+	}
+}
+
+// sendPrinter sends a whole packet and returns what the printer answered
+// to the last two bytes.
+func sendPrinter(p *Printer, cmd byte, compress bool, data []byte, sum uint16) (byte, byte) {
+	packet := []byte{0x88, 0x33, cmd, 0, byte(len(data)), byte(len(data) >> 8)}
+	if compress {
+		packet[3] = 1
+	}
+	packet = append(packet, data...)
+	packet = append(packet, byte(sum), byte(sum>>8), 0, 0)
+
+	var ack, status byte
+	for i, b := range packet {
+		r := p.Transfer(b)
+		switch i {
+		case len(packet) - 2:
+			ack = r
+		case len(packet) - 1:
+			status = r
+		}
+	}
+	return ack, status
+}
+
+func printerPacket(p *Printer, cmd byte, compress bool, data []byte) (byte, byte) {
+	sum := uint16(cmd) + uint16(len(data)&0xff) + uint16(len(data)>>8)
+	if compress {
+		sum++
+	}
+	for _, b := range data {
+		sum += uint16(b)
+	}
+	return sendPrinter(p, cmd, compress, data, sum)
+}
+
+func TestPrinterPackets(t *testing.T) {
+	p := NewPrinter(filepath.Join(t.TempDir(), "print"))
+
+	if ack, status := printerPacket(p, printerInit, false, nil); ack != 0x81 || status != 0 {
+		t.Errorf("INIT answered 0x%02x 0x%02x", ack, status)
+	}
+
+	// noise before a packet is skipped
+	p.Transfer(0x00)
+	p.Transfer(0x12)
+	if _, status := printerPacket(p, printerData, false, make([]byte, printerRowBytes)); status != printerUnprocessed {
+		t.Errorf("DATA status 0x%02x", status)
+	}
+	if len(p.data) != printerRowBytes {
+		t.Errorf("%d bytes of data", len(p.data))
+	}
+
+	// a bad checksum is reported and the packet dropped
+	if _, status := sendPrinter(p, printerData, false, []byte{1, 2, 3}, 0); status&printerChecksumError == 0 {
+		t.Errorf("bad checksum gave status 0x%02x", status)
+	}
+	if len(p.data) != printerRowBytes {
+		t.Errorf("bad packet added data, %d bytes", len(p.data))
+	}
+	if _, status := printerPacket(p, printerStatus, false, nil); status&printerChecksumError != 0 {
+		t.Errorf("checksum error stuck, status 0x%02x", status)
+	}
+
+	// compressed data, then the printer is full
+	for i := 0; i < 8; i++ {
+		printerPacket(p, printerData, true, []byte{0xff, 0x00, 0xff, 0x00, 0xff, 0x00, 0xff, 0x00, 0xff, 0x00, 0xc4, 0xff})
+	}
+	if _, status := printerPacket(p, printerStatus, false, nil); status != printerUnprocessed|printerFull {
+		t.Errorf("full status 0x%02x", status)
+	}
+
+	// printing is busy for a few status polls
+	_, status := printerPacket(p, printerPrint, false, []byte{1, 0x00, 0xe4, 0x40})
+	if status != printerBusy {
+		t.Errorf("PRINT status 0x%02x", status)
+	}
+	for i := 0; i < 3; i++ {
+		_, status = printerPacket(p, printerStatus, false, nil)
+	}
+	if status != 0 {
+		t.Errorf("still busy, status 0x%02x", status)
+	}
+	if len(p.image) != 9*2*8 {
+		t.Errorf("printout has %d lines", len(p.image))
+	}
+}
+
+func TestPrinterMargins(t *testing.T) {
+	p := NewPrinter(filepath.Join(t.TempDir(), "print"))
+
+	// one row of tiles in color 3, printed with palette 0, one unit of feed
+	// before and two after
+	row := make([]byte, printerRowBytes/2)
+	for i := range row {
+		row[i] = 0xff
+	}
+	printerPacket(p, printerInit, false, nil)
+	printerPacket(p, printerData, false, row)
+	printerPacket(p, printerPrint, false, []byte{1, 0x12, 0x00, 0x40})
+	if len(p.Files) != 1 {
+		t.Fatalf("%d files printed", len(p.Files))
+	}
+
+	f, err := os.Open(p.Files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed := printerFeedLines
+	if got, want := img.Bounds(), image.Rect(0, 0, 160, feed+8+2*feed); got != want {
+		t.Fatalf("printout is %v, want %v", got, want)
+	}
+	for _, tc := range []struct {
+		y    int
+		want uint8
+	}{
+		{0, 0xff},
+		{feed - 1, 0xff},
+		{feed, 0x00}, // palette 0 is 0xe4, color 3 black
+		{feed + 7, 0x00},
+		{feed + 8, 0xff},
+		{3*feed + 7, 0xff},
+	} {
+		r, _, _, _ := img.At(80, tc.y).RGBA()
+		if got := uint8(r >> 8); got != tc.want {
+			t.Errorf("line %d is 0x%02x, want 0x%02x", tc.y, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Rewind keeps the newest save state and, for every older snapshot, the
+// compressed XOR with the one after it. Consecutive states differ in a few
+// hundred bytes, so the deltas are mostly zeros and compress very well.
+type Rewind struct {
+	interval int // frames between snapshots
+
+	latest []byte
+	deltas []rewindDelta // ring buffer
+	head   int           // oldest delta
+	count  int
+
+	frames  int  // since the last snapshot
+	shown   int  // frames left to show the snapshot while rewinding
+	started bool // the newest snapshot was loaded
+
+	zip *flate.Writer
+	buf bytes.Buffer
+}
+
+type rewindDelta struct {
+	size int // length of the older state
+	data []byte
+}
+
+// NewRewind keeps about seconds of history, a snapshot every interval
+// frames.
+func NewRewind(seconds float64, interval int) *Rewind {
+	if interval < 1 {
+		interval = 1
+	}
+	n := int(seconds * FrameRate / float64(interval))
+	if n < 1 {
+		n = 1
+	}
+
+	zip, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &Rewind{interval: interval, deltas: make([]rewindDelta, n), zip: zip}
+}
+
+// xorStates pads the shorter state with zeros.
+func xorStates(a, b []byte) []byte {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	out := make([]byte, len(a))
+	copy(out, a)
+	for i, v := range b {
+		out[i] ^= v
+	}
+	return out
+}
+
+func (r *Rewind) push(state []byte) {
+	if r.latest != nil {
+		r.buf.Reset()
+		r.zip.Reset(&r.buf)
+		r.zip.Write(xorStates(r.latest, state))
+		r.zip.Close()
+
+		d := rewindDelta{size: len(r.latest), data: append([]byte(nil), r.buf.Bytes()...)}
+		if r.count == len(r.deltas) {
+			// full, the oldest snapshot goes
+			r.head = (r.head + 1) % len(r.deltas)
+			r.count--
+		}
+		r.deltas[(r.head+r.count)%len(r.deltas)] = d
+		r.count++
+	}
+	r.latest = state
+}
+
+// pop goes back to the snapshot before the newest one, it returns nil when
+// the history is used up.
+func (r *Rewind) pop() ([]byte, error) {
+	if r.count == 0 {
+		return nil, nil
+	}
+
+	r.count--
+	i := (r.head + r.count) % len(r.deltas)
+	d := r.deltas[i]
+	r.deltas[i] = rewindDelta{}
+
+	delta, err := io.ReadAll(flate.NewReader(bytes.NewReader(d.data)))
+	if err != nil {
+		r.clear()
+		return nil, err
+	}
+	r.latest = xorStates(r.latest, delta)[:d.size]
+	return r.latest, nil
+}
+
+func (r *Rewind) clear() {
+	for i := range r.deltas {
+		r.deltas[i] = rewindDelta{}
+	}
+	r.latest = nil
+	r.head, r.count = 0, 0
+	r.frames, r.shown = 0, 0
+	r.started = false
+}
+
+// Size is the memory the history takes.
+func (r *Rewind) Size() int {
+	n := len(r.latest)
+	for _, d := range r.deltas {
+		n += len(d.data)
+	}
+	return n
+}
+
+// SetRewind enables rewinding with that many seconds of history, 0 turns
+// it off.
+func (c *CPU) SetRewind(seconds float64, interval int) {
+	c.rewind = nil
+	c.rewinding = false
+	if seconds > 0 {
+		c.rewind = NewRewind(seconds, interval)
+	}
+}
+
+// snapshot is called at the end of every frame.
+func (c *CPU) snapshot() {
+	if c.rewind == nil || c.rewinding {
+		return
+	}
+
+	c.rewind.frames++
+	if c.rewind.frames < c.rewind.interval {
+		return
+	}
+	c.rewind.frames = 0
+
+	state, err := c.SaveState()
+	if err != nil {
+		fmt.Printf("Can't save rewind state: %v\n", err)
+		return
+	}
+	c.rewind.push(state)
+}
+
+func (c *CPU) setRewinding(on bool) {
+	if c.rewind == nil || c.rewinding == on {
+		return
+	}
+	if on && c.movieLocked("rewind") {
+		return
+	}
+	c.rewinding = on
+	c.rewind.frames = 0
+	c.rewind.shown = 0
+	c.rewind.started = false
+}
+
+// rewindFrame replaces a frame of emulation while rewinding, every
+// snapshot stays on screen as long as it took to play, so going back runs
+// at the normal speed.
+func (c *CPU) rewindFrame() {
+	r := c.rewind
+	if r.shown == 0 {
+		// back to the newest snapshot first, then further
+		state := r.latest
+		if r.started {
+			var err error
+			if state, err = r.pop(); err != nil {
+				fmt.Printf("Can't rewind: %v\n", err)
+			}
+		}
+		r.started = true
+		if state != nil {
+			if err := c.LoadState(state); err != nil {
+				fmt.Printf("Can't rewind: %v\n", err)
+				r.clear()
+			}
+			r.shown = r.interval
+		}
+	}
+	if r.shown > 0 {
+		r.shown--
+	}
+
+	c.idle()
+}
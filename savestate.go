@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A save state is "GBST", the format version, the cartridge header the
+// state belongs to and then every component's fields in a fixed order,
+// little endian.
+const (
+	stateMagic   = "GBST"
+	stateVersion = 1
+)
+
+var errStateROM = errors.New("state belongs to a different ROM")
+
+// stateIO either writes or reads the fields it is given, so every
+// component lists its state exactly once for both directions.
+type stateIO struct {
+	w   *bytes.Buffer
+	r   *bytes.Reader
+	err error
+
+	machine bool // only the emulated hardware, not the host's sound output
+}
+
+func (s *stateIO) loading() bool {
+	return s.r != nil
+}
+
+// fixed handles pointers to fixed size values, arrays of them and slices,
+// slices keep their length.
+func (s *stateIO) fixed(vs ...interface{}) {
+	for _, v := range vs {
+		if s.err != nil {
+			return
+		}
+		if s.loading() {
+			s.err = binary.Read(s.r, binary.LittleEndian, v)
+		} else {
+			s.err = binary.Write(s.w, binary.LittleEndian, v)
+		}
+	}
+}
+
+func (s *stateIO) int(vs ...*int) {
+	for _, v := range vs {
+		n := int64(*v)
+		s.fixed(&n)
+		*v = int(n)
+	}
+}
+
+// bytes handles a slice whose length can change, nil stays nil.
+func (s *stateIO) bytes(b *[]byte) {
+	n := int32(-1)
+	if *b != nil {
+		n = int32(len(*b))
+	}
+	s.fixed(&n)
+	if !s.loading() {
+		s.fixed(*b)
+		return
+	}
+
+	if s.err != nil || n < 0 {
+		*b = nil
+		return
+	}
+	if int(n) > s.r.Len() {
+		s.err = errors.New("state is truncated")
+		return
+	}
+	*b = make([]byte, n)
+	s.fixed(*b)
+}
+
+// words is bytes for uint16 slices.
+func (s *stateIO) words(b *[]uint16) {
+	n := int32(-1)
+	if *b != nil {
+		n = int32(len(*b))
+	}
+	s.fixed(&n)
+	if !s.loading() {
+		s.fixed(*b)
+		return
+	}
+
+	if s.err != nil || n < 0 {
+		*b = nil
+		return
+	}
+	if int(n)*2 > s.r.Len() {
+		s.err = errors.New("state is truncated")
+		return
+	}
+	*b = make([]uint16, n)
+	s.fixed(*b)
+}
+
+func (c *CPU) state(s *stateIO) {
+	var header [0x150 - 0x134]byte
+	copy(header[:], c.rom[0x134:0x150])
+	magic := []byte(stateMagic)
+	version := uint16(stateVersion)
+
+	s.fixed(magic, &version)
+	if s.err == nil && (string(magic) != stateMagic || version > stateVersion) {
+		s.err = fmt.Errorf("not a save state or a newer version")
+		return
+	}
+	s.fixed(&header)
+	if s.err == nil && !bytes.Equal(header[:], c.rom[0x134:0x150]) {
+		s.err = errStateROM
+		return
+	}
+
+	hasSGB := c.sgb != nil
+	s.fixed(&c.hwCGB, &c.cgb, &hasSGB)
+	if s.loading() && s.err == nil {
+		c.sgb = nil
+		if hasSGB {
+			c.sgb = NewSGB(c)
+		}
+	}
+
+	s.fixed(&c.Register, &c.RSV, &c.isCB, &c.Ie, &c.If, &c.inBios)
+	s.fixed(&c.Clock, &c.dots)
+	s.fixed(c.ram, c.wram, &c.svbk)
+	s.fixed(&c.doubleSpeed, &c.key1, &c.speedSwitch, &c.stall)
+	s.fixed(&c.romoffs, &c.ramoffs)
+	s.fixed(&c.mbc1.rombank, &c.mbc1.rambank, &c.mbc1.ramon, &c.mbc1.mode)
+
+	c.gpu.state(s)
+	c.apu.state(s)
+	s.fixed(&c.timer.div, &c.timer.tima, &c.timer.tma, &c.timer.tac)
+	s.fixed(&c.hdma.src, &c.hdma.dst, &c.hdma.blocks, &c.hdma.hblank)
+	s.fixed(&c.serial.sb, &c.serial.sc)
+	s.int(&c.serial.clocks)
+	s.fixed(&c.joypad.sel)
+	if c.sgb != nil {
+		c.sgb.state(s)
+	}
+}
+
+func (g *GPU) state(s *stateIO) {
+	s.fixed(g.reg, g.oam, g.vram, &g.vbk)
+	s.fixed(g.paletteBg, g.paletteObj0, g.paletteObj1)
+	s.fixed(&g.cgbBg, &g.cgbObj, &g.bcps, &g.ocps)
+
+	for i := range g.objdata {
+		o := &g.objdata[i]
+		s.fixed(&o.x, &o.y, &o.tile, &o.palette, &o.xflip, &o.yflip, &o.prio, &o.num, &o.bank, &o.cgbpal)
+	}
+
+	s.fixed(&g.modeClocks, &g.lineMode, &g.curLine, &g.lcdon)
+	s.fixed(&g.bgtilebase, &g.bgmapbase, &g.winmapbase, &g.winon, &g.winLine)
+	s.fixed(&g.objsize, &g.objon, &g.bgon, &g.yscrl, &g.xscrl, &g.raster)
+	s.fixed(g.frame)
+
+	if s.loading() && s.err == nil {
+		// the decoded tiles are just a cache of VRAM
+		vbk := g.vbk
+		for g.vbk = 0; g.vbk < 2; g.vbk++ {
+			for addr := uint16(0); addr < 0x2000; addr += 2 {
+				g.UpdateTile(addr, 0)
+			}
+		}
+		g.vbk = vbk
+	}
+}
+
+func (a *APU) state(s *stateIO) {
+	s.fixed(&a.on, &a.regs, &a.seqStep)
+
+	for _, sq := range []*square{&a.ch1, &a.ch2} {
+		s.fixed(&sq.enabled, &sq.duty, &sq.pos, &sq.freq)
+		s.int(&sq.timer)
+		s.fixed(&sq.sweepPeriod, &sq.sweepNeg, &sq.sweepShift, &sq.sweepTimer, &sq.sweepOn, &sq.shadow)
+		sq.length.state(s)
+		sq.env.state(s)
+	}
+
+	w := &a.ch3
+	s.fixed(&w.enabled, &w.dacOn, &w.volume, &w.freq, &w.pos, &w.sample, &w.ram)
+	s.int(&w.timer)
+	w.length.state(s)
+
+	n := &a.ch4
+	s.fixed(&n.enabled, &n.shift, &n.width7, &n.divisor, &n.lfsr)
+	s.int(&n.timer)
+	n.length.state(s)
+	n.env.state(s)
+
+	// the output filters too, or the sound clicks after loading, they
+	// depend on the host's sample rate and rate control though
+	if s.machine {
+		return
+	}
+	s.fixed(&a.time, &a.capL, &a.capR)
+	for i := range a.blips {
+		b := &a.blips[i]
+		s.fixed(&b.buf, &b.sum, &b.level)
+		s.int(&b.pos)
+	}
+}
+
+func (l *length) state(s *stateIO) {
+	s.int(&l.counter)
+	s.fixed(&l.on)
+}
+
+func (e *envelope) state(s *stateIO) {
+	s.fixed(&e.initial, &e.up, &e.period, &e.volume, &e.timer)
+}
+
+func (sg *SGB) state(s *stateIO) {
+	s.fixed(&sg.sel, &sg.receiving, &sg.packet)
+	s.int(&sg.bit, &sg.players)
+	s.bytes(&sg.data)
+	s.fixed(&sg.player, &sg.pals, &sg.sysPals, &sg.attr, &sg.mask)
+	s.words(&sg.frozen)
+	s.fixed(&sg.transfer, &sg.chrHigh, &sg.tiles, &sg.borderMap, &sg.borderPal)
+}
+
+// SaveState serializes the whole machine.
+func (c *CPU) SaveState() ([]byte, error) {
+	return c.writeState(false)
+}
+
+// machineState is SaveState without the host side, two emulators running
+// the same input have equal machine states whatever their sound output.
+func (c *CPU) machineState() ([]byte, error) {
+	return c.writeState(true)
+}
+
+func (c *CPU) writeState(machine bool) ([]byte, error) {
+	s := &stateIO{w: new(bytes.Buffer), machine: machine}
+	c.state(s)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.w.Bytes(), nil
+}
+
+// LoadState restores a state from SaveState, the machine is left as it
+// was if that fails.
+func (c *CPU) LoadState(data []byte) error {
+	backup, err := c.SaveState()
+	if err != nil {
+		return err
+	}
+
+	s := &stateIO{r: bytes.NewReader(data)}
+	c.state(s)
+	if s.err == nil && s.r.Len() != 0 {
+		s.err = errors.New("trailing data after the state")
+	}
+	if s.err != nil {
+		if s.err != errStateROM {
+			c.state(&stateIO{r: bytes.NewReader(backup)})
+		}
+		return s.err
+	}
+
+	c.Pacer.next = 0
+	c.Pacer.start = time.Time{}
+	c.present()
+	return nil
+}
+
+func (c *CPU) SaveStateFile(path string) error {
+	data, err := c.SaveState()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (c *CPU) LoadStateFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return c.LoadState(data)
+}
+
+// StatePath is the file of a numbered slot, next to the ROM like
+// game.ss1.
+func (c *CPU) StatePath(slot int) string {
+	base := strings.TrimSuffix(c.romPath, filepath.Ext(c.romPath))
+	return fmt.Sprintf("%s.ss%d", base, slot)
+}
+
+func (c *CPU) saveSlot() {
+	path := c.StatePath(c.stateSlot)
+	if err := c.SaveStateFile(path); err != nil {
+		fmt.Printf("Can't save state: %v\n", err)
+		return
+	}
+	fmt.Printf("Saved state %d to %s\n", c.stateSlot, path)
+}
+
+func (c *CPU) loadSlot() {
+	if c.movieLocked("load a state") {
+		return
+	}
+	path := c.StatePath(c.stateSlot)
+	if err := c.LoadStateFile(path); err != nil {
+		fmt.Printf("Can't load state: %v\n", err)
+		return
+	}
+	fmt.Printf("Loaded state %d\n", c.stateSlot)
+}
+
+// twin returns a headless emulator with the same cartridge and settings.
+func (c *CPU) twin() *CPU {
+	t := NewCPU(NewHeadlessBackend())
+	t.rom, t.romPath = c.rom, c.romPath
+	t.boot, t.cgbBoot = c.boot, c.cgbBoot
+	t.model, t.compatCombo = c.model, c.compatCombo
+	t.colors, t.correction = c.colors, c.correction
+	t.apu.SetSampleRate(c.apu.rate)
+	t.apu.SetAccurate(c.apu.accurate)
+	t.HardReset()
+	return t
+}
+
+// CheckStateDeterminism saves the state, loads it into a fresh emulator
+// and runs both for the given number of frames. Their states have to be
+// identical then, otherwise something isn't saved.
+func (c *CPU) CheckStateDeterminism(frames int) error {
+	start, err := c.SaveState()
+	if err != nil {
+		return err
+	}
+
+	t := c.twin()
+	if err := t.LoadState(start); err != nil {
+		return err
+	}
+	if copied, _ := t.SaveState(); !bytes.Equal(copied, start) {
+		return errors.New("state changed by loading it")
+	}
+
+	c.RunFrames(frames)
+	t.RunFrames(frames)
+
+	a, err := c.SaveState()
+	if err != nil {
+		return err
+	}
+	b, err := t.SaveState()
+	if err != nil {
+		return err
+	}
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return fmt.Errorf("states differ at byte %d after %d frames", i, frames)
+		}
+	}
+	if len(a) != len(b) {
+		return fmt.Errorf("state sizes differ after %d frames", frames)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestStateDeterminism(t *testing.T) {
+	for _, model := range []Model{ModelDMG, ModelCGB, ModelSGB} {
+		c := newTestCPU(t, model)
+		c.RunFrames(5)
+		if err := c.CheckStateDeterminism(30); err != nil {
+			t.Errorf("model %d: %v", model, err)
+		}
+	}
+}
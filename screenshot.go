@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// Screenshot saves the last frame as a PNG, scaled up by whole multiples.
+func (c *CPU) Screenshot(path string, scale int) error {
+	img := scaleImage(c.FrameImage(), scale)
+	return writePNG(path, img)
+}
+
+func scaleImage(src *image.RGBA, scale int) *image.RGBA {
+	if scale <= 1 {
+		return src
+	}
+
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w*scale, h*scale))
+	for y := 0; y < h*scale; y++ {
+		for x := 0; x < w*scale; x++ {
+			i := src.PixOffset(x/scale, y/scale)
+			copy(dst.Pix[dst.PixOffset(x, y):], src.Pix[i:i+4])
+		}
+	}
+	return dst
+}
+
+// takeScreenshot is the hotkey, scaled like the window with shift.
+func (c *CPU) takeScreenshot(scaled bool) {
+	scale := 1
+	if scaled {
+		scale = c.screenshotScale
+	}
+
+	name := timestamped("png")
+	if err := c.Screenshot(name, scale); err != nil {
+		fmt.Printf("Screenshot failed: %v\n", err)
+		return
+	}
+	fmt.Printf("Screenshot saved to %s\n", name)
+}
@@ -0,0 +1,265 @@
+//go:build !nosdl
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+type SDLVideo struct {
+	window   *sdl.Window
+	renderer *sdl.Renderer
+	texture  *sdl.Texture
+
+	letterbox bool
+	scale     int32
+	width     int32 // texture size
+	height    int32
+}
+
+func (v *SDLVideo) Present(pixels []byte, width, height int) {
+	if int32(width) != v.width || int32(height) != v.height {
+		if err := v.resize(int32(width), int32(height)); err != nil {
+			fmt.Printf("Can't resize screen: %v\n", err)
+			return
+		}
+	}
+
+	v.texture.Update(nil, unsafe.Pointer(&pixels[0]), width*4)
+	v.redraw()
+}
+
+// resize switches to a new output size, e.g. when the SGB border shows up.
+func (v *SDLVideo) resize(w, h int32) error {
+	texture, err := v.renderer.CreateTexture(sdl.PIXELFORMAT_ARGB8888, sdl.TEXTUREACCESS_STREAMING, w, h)
+	if err != nil {
+		return err
+	}
+	if v.texture != nil {
+		v.texture.Destroy()
+	}
+	v.texture = texture
+	v.width, v.height = w, h
+
+	v.window.SetMinimumSize(w, h)
+	if v.window.GetFlags()&sdl.WINDOW_FULLSCREEN_DESKTOP == 0 {
+		v.window.SetSize(w*v.scale, h*v.scale)
+	}
+	return nil
+}
+
+func (v *SDLVideo) redraw() {
+	w, h, err := v.renderer.GetOutputSize()
+	if err != nil {
+		return
+	}
+
+	v.renderer.SetDrawColor(0, 0, 0, 255)
+	v.renderer.Clear()
+	v.renderer.Copy(v.texture, nil, v.dest(w, h))
+	v.renderer.Present()
+}
+
+// dest fits the screen into a w*h output, by whole multiples of the native
+// resolution unless letterboxing is on.
+func (v *SDLVideo) dest(w, h int32) *sdl.Rect {
+	var dw, dh int32
+	if v.letterbox {
+		if w*v.height > h*v.width {
+			dw, dh = h*v.width/v.height, h
+		} else {
+			dw, dh = w, w*v.height/v.width
+		}
+	} else {
+		scale := w / v.width
+		if h/v.height < scale {
+			scale = h / v.height
+		}
+		if scale < 1 {
+			scale = 1
+		}
+		dw, dh = v.width*scale, v.height*scale
+	}
+
+	return &sdl.Rect{X: (w - dw) / 2, Y: (h - dh) / 2, W: dw, H: dh}
+}
+
+func (v *SDLVideo) ToggleFullscreen() {
+	if v.window.GetFlags()&sdl.WINDOW_FULLSCREEN_DESKTOP != 0 {
+		v.window.SetFullscreen(0)
+	} else {
+		v.window.SetFullscreen(sdl.WINDOW_FULLSCREEN_DESKTOP)
+	}
+	v.redraw()
+}
+
+func (v *SDLVideo) Close() {
+	v.texture.Destroy()
+	v.renderer.Destroy()
+	v.window.Destroy()
+	sdl.Quit()
+}
+
+type SDLInput struct {
+	video *SDLVideo
+}
+
+func (in *SDLInput) Poll() []Event {
+	var ret []Event
+	for event := sdl.PollEvent(); event != nil; event = sdl.PollEvent() {
+		switch t := event.(type) {
+		case *sdl.QuitEvent:
+			ret = append(ret, Event{Type: EventQuit})
+		case *sdl.WindowEvent:
+			if t.Event == sdl.WINDOWEVENT_SIZE_CHANGED {
+				in.video.redraw()
+			}
+		case *sdl.KeyboardEvent:
+			if t.Repeat != 0 {
+				break
+			}
+			e := Event{Type: EventKeyDown, Key: sdlKey(t.Keysym.Sym), Shift: t.Keysym.Mod&sdl.KMOD_SHIFT != 0}
+			if t.Type == sdl.KEYUP {
+				e.Type = EventKeyUp
+			}
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+func (in *SDLInput) Close() {
+}
+
+func sdlKey(sym sdl.Keycode) Key {
+	switch sym {
+	case sdl.K_UP:
+		return KeyUp
+	case sdl.K_DOWN:
+		return KeyDown
+	case sdl.K_LEFT:
+		return KeyLeft
+	case sdl.K_RIGHT:
+		return KeyRight
+	case sdl.K_LSHIFT, sdl.K_RSHIFT:
+		return KeyShift
+	}
+	if sym >= sdl.K_F1 && sym <= sdl.K_F12 {
+		return KeyF1 + Key(sym-sdl.K_F1)
+	}
+	return Key(sym)
+}
+
+type SDLAudio struct {
+	dev  sdl.AudioDeviceID
+	rate int
+}
+
+func (a *SDLAudio) Queue(samples []int16) {
+	if len(samples) == 0 {
+		return
+	}
+
+	// while fast-forwarding more sound is made than played, drop it instead
+	// of building up lag
+	if a.Buffered() > 4*audioLatency {
+		return
+	}
+
+	sdl.QueueAudio(a.dev, unsafe.Slice((*byte)(unsafe.Pointer(&samples[0])), len(samples)*2))
+}
+
+func (a *SDLAudio) Buffered() time.Duration {
+	return time.Duration(sdl.GetQueuedAudioSize(a.dev)/4) * time.Second / time.Duration(a.rate)
+}
+
+func (a *SDLAudio) Close() {
+	sdl.CloseAudioDevice(a.dev)
+}
+
+func openSDLAudio(rate int) (*SDLAudio, error) {
+	if err := sdl.InitSubSystem(sdl.INIT_AUDIO); err != nil {
+		return nil, err
+	}
+
+	spec := sdl.AudioSpec{
+		Freq:     int32(rate),
+		Format:   sdl.AUDIO_S16SYS,
+		Channels: 2,
+		Samples:  1024,
+	}
+	dev, err := sdl.OpenAudioDevice("", false, &spec, nil, 0)
+	if err != nil {
+		sdl.QuitSubSystem(sdl.INIT_AUDIO)
+		return nil, err
+	}
+	sdl.PauseAudioDevice(dev, false)
+
+	return &SDLAudio{dev: dev, rate: rate}, nil
+}
+
+func NewSDLBackend(cfg VideoConfig, sampleRate int) (Backend, error) {
+	if err := sdl.Init(sdl.INIT_VIDEO | sdl.INIT_EVENTS); err != nil {
+		return Backend{}, err
+	}
+
+	scale := int32(cfg.Scale)
+	if scale < 1 {
+		scale = 1
+	} else if scale > 8 {
+		scale = 8
+	}
+
+	flags := uint32(sdl.WINDOW_SHOWN | sdl.WINDOW_RESIZABLE)
+	if cfg.Fullscreen {
+		flags |= sdl.WINDOW_FULLSCREEN_DESKTOP
+	}
+
+	window, err := sdl.CreateWindow("GoGB", sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED, ScreenWidth*scale, ScreenHeight*scale, flags)
+	if err != nil {
+		return Backend{}, err
+	}
+	window.SetMinimumSize(ScreenWidth, ScreenHeight)
+
+	renderer, err := sdl.CreateRenderer(window, -1, sdl.RENDERER_ACCELERATED)
+	if err != nil {
+		renderer, err = sdl.CreateRenderer(window, -1, sdl.RENDERER_SOFTWARE)
+		if err != nil {
+			window.Destroy()
+			return Backend{}, err
+		}
+	}
+
+	// nearest neighbor
+	sdl.SetHint(sdl.HINT_RENDER_SCALE_QUALITY, "0")
+
+	video := &SDLVideo{window: window, renderer: renderer, letterbox: cfg.Letterbox, scale: scale}
+	if err := video.resize(ScreenWidth, ScreenHeight); err != nil {
+		renderer.Destroy()
+		window.Destroy()
+		return Backend{}, err
+	}
+
+	white := make([]byte, ScreenWidth*ScreenHeight*4)
+	for i := range white {
+		white[i] = 0xff
+	}
+	video.Present(white, ScreenWidth, ScreenHeight)
+
+	var audio Audio
+	audio, err = openSDLAudio(sampleRate)
+	if err != nil {
+		fmt.Printf("No sound: %v\n", err)
+		audio = new(HeadlessAudio)
+	}
+
+	return Backend{
+		Video: video,
+		Input: &SDLInput{video: video},
+		Audio: audio,
+	}, nil
+}
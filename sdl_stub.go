@@ -0,0 +1,9 @@
+//go:build nosdl
+
+package main
+
+import "errors"
+
+func NewSDLBackend(cfg VideoConfig, sampleRate int) (Backend, error) {
+	return Backend{}, errors.New("built without SDL support (nosdl), use -headless")
+}
@@ -0,0 +1,101 @@
+package main
+
+// SerialDevice is whatever is plugged into the link port.
+type SerialDevice interface {
+	// Transfer is called when the Game Boy clocked out a whole byte on its
+	// internal clock, it returns the byte shifted in meanwhile.
+	Transfer(out byte) byte
+
+	// Receive is polled while the Game Boy waits for the other side to
+	// drive the clock. If that side sent a byte, out goes back to it and
+	// ok is true.
+	Receive(out byte) (in byte, ok bool)
+}
+
+// internal clock cycles per bit, 8192 Hz or 262144 Hz with CGB fast mode
+const (
+	serialSlow = ClockSpeed / 8192
+	serialFast = ClockSpeed / 262144
+)
+
+type Serial struct {
+	cpu    *CPU
+	device SerialDevice
+
+	sb     byte
+	sc     byte
+	clocks int // left until an internal clock transfer is done
+}
+
+func (s *Serial) ReadByte(addr uint16) byte {
+	if addr == 0xff01 {
+		return s.sb
+	}
+
+	if s.cpu.cgb {
+		return 0x7c | s.sc
+	}
+	return 0x7e | s.sc
+}
+
+func (s *Serial) WriteByte(addr uint16, value byte) {
+	if addr == 0xff01 {
+		s.sb = value
+		return
+	}
+
+	s.sc = value & 0x83
+	if !s.cpu.cgb {
+		s.sc &^= 0x02
+	}
+
+	if s.sc&0x81 == 0x81 {
+		period := serialSlow
+		if s.sc&0x02 != 0 {
+			period = serialFast
+		}
+		s.clocks = 8 * period
+	}
+}
+
+// Tick runs with the CPU clock, so double speed mode doubles the transfer
+// rate too.
+func (s *Serial) Tick(cycles uint16) {
+	if s.sc&0x80 == 0 {
+		return
+	}
+
+	if s.sc&0x01 == 0 {
+		// external clock, wait for the other side
+		if s.device == nil {
+			return
+		}
+		if in, ok := s.device.Receive(s.sb); ok {
+			s.done(in)
+		}
+		return
+	}
+
+	s.clocks -= int(cycles)
+	if s.clocks > 0 {
+		return
+	}
+
+	// with nothing connected the line stays high
+	in := byte(0xff)
+	if s.device != nil {
+		in = s.device.Transfer(s.sb)
+	}
+	s.done(in)
+}
+
+func (s *Serial) done(in byte) {
+	s.sb = in
+	s.sc &^= 0x80
+	s.cpu.If |= 0x08
+}
+
+// ConnectSerial plugs a device into the link port, nil unplugs it.
+func (c *CPU) ConnectSerial(d SerialDevice) {
+	c.serial.device = d
+}
@@ -0,0 +1,402 @@
+package main
+
+// The Super Game Boy colors the DMG picture with four palettes assigned
+// per 8x8 cell and draws a border around it. Games talk to it with
+// packets sent bit by bit through P14/P15, larger data is transferred by
+// showing it on screen.
+
+const (
+	sgbPal01   = 0x00
+	sgbPal23   = 0x01
+	sgbPal03   = 0x02
+	sgbPal12   = 0x03
+	sgbAttrBlk = 0x04
+	sgbAttrLin = 0x05
+	sgbAttrDiv = 0x06
+	sgbAttrChr = 0x07
+	sgbPalSet  = 0x0a
+	sgbPalTrn  = 0x0b
+	sgbMltReq  = 0x11
+	sgbChrTrn  = 0x13
+	sgbPctTrn  = 0x14
+	sgbMaskEn  = 0x17
+)
+
+// what MASK_EN shows instead of the game
+const (
+	sgbMaskOff = iota
+	sgbMaskFreeze
+	sgbMaskBlack
+	sgbMaskColor0
+)
+
+type SGB struct {
+	cpu *CPU
+
+	// packet reception
+	sel       byte // last P14/P15 write
+	receiving bool
+	bit       int
+	packet    [16]byte
+	data      []byte // all packets of the current command
+
+	players int
+	player  byte
+
+	pals    [4][4]uint16 // RGB555, color 0 is shared
+	sysPals [512][4]uint16
+	attr    [20 * 18]byte // palette of every 8x8 cell
+
+	mask   byte
+	frozen []uint16
+
+	transfer byte // VRAM transfer waiting for the next frame, 0 for none
+	chrHigh  bool // CHR_TRN to tiles 0x80-0xff
+
+	tiles     [256][8][8]byte // 4bpp border tiles
+	borderMap [32 * 28]uint16
+	borderPal [4][16]uint16 // palettes 4-7
+
+	out []uint16
+}
+
+func NewSGB(cpu *CPU) *SGB {
+	s := &SGB{cpu: cpu, players: 1}
+	for i := range s.pals {
+		s.pals[i] = [4]uint16{0x67bf, 0x265b, 0x10b5, 0x2866}
+	}
+	s.out = make([]uint16, SGBWidth*SGBHeight)
+	return s
+}
+
+// write gets the P14/P15 bits of every JOYP write.
+func (s *SGB) write(sel byte) {
+	old := s.sel
+	s.sel = sel
+
+	switch sel {
+	case 0x00:
+		// reset pulse, a packet follows
+		s.receiving = true
+		s.bit = 0
+		s.packet = [16]byte{}
+	case 0x10, 0x20:
+		if !s.receiving || old != 0x30 {
+			break
+		}
+		if s.bit == 128 {
+			// stop bit
+			s.receiving = false
+			if sel == 0x20 {
+				s.receivePacket()
+			}
+			break
+		}
+		if sel == 0x10 {
+			s.packet[s.bit>>3] |= 1 << uint(s.bit&7)
+		}
+		s.bit++
+	case 0x30:
+		// the next controller is selected by releasing P15
+		if old == 0x10 && !s.receiving && s.players > 1 {
+			s.player = (s.player + 1) % byte(s.players)
+		}
+	}
+}
+
+// readPlayer returns the lower JOYP bits with both lines released, they
+// tell the game which controller is selected.
+func (s *SGB) readPlayer() byte {
+	return 0x0f - s.player
+}
+
+func (s *SGB) receivePacket() {
+	if len(s.data) == 0 && s.packet[0]&7 == 0 {
+		// not a command
+		return
+	}
+
+	s.data = append(s.data, s.packet[:]...)
+	if len(s.data) < int(s.data[0]&7)*16 {
+		return
+	}
+
+	s.command(s.data[0]>>3, s.data)
+	s.data = s.data[:0]
+}
+
+func color16(b []byte) uint16 {
+	return (uint16(b[0]) | uint16(b[1])<<8) & 0x7fff
+}
+
+func (s *SGB) command(cmd byte, d []byte) {
+	switch cmd {
+	case sgbPal01, sgbPal23, sgbPal03, sgbPal12:
+		pairs := [][2]int{{0, 1}, {2, 3}, {0, 3}, {1, 2}}[cmd]
+		c0 := color16(d[1:])
+		for i := range s.pals {
+			s.pals[i][0] = c0
+		}
+		for c := 1; c < 4; c++ {
+			s.pals[pairs[0]][c] = color16(d[1+c*2:])
+			s.pals[pairs[1]][c] = color16(d[7+c*2:])
+		}
+
+	case sgbAttrBlk:
+		n := int(d[1])
+		for i := 0; i < n && 2+i*6+5 < len(d); i++ {
+			s.attrBlock(d[2+i*6:])
+		}
+
+	case sgbAttrLin:
+		n := int(d[1])
+		for i := 0; i < n && 2+i < len(d); i++ {
+			v := d[2+i]
+			line := int(v & 0x1f)
+			pal := (v >> 5) & 3
+			if v&0x80 != 0 {
+				for x := 0; x < 20 && line < 18; x++ {
+					s.attr[line*20+x] = pal
+				}
+			} else {
+				for y := 0; y < 18 && line < 20; y++ {
+					s.attr[y*20+line] = pal
+				}
+			}
+		}
+
+	case sgbAttrDiv:
+		low, high, on := d[1]&3, (d[1]>>2)&3, (d[1]>>4)&3
+		split := int(d[2])
+		for y := 0; y < 18; y++ {
+			for x := 0; x < 20; x++ {
+				pos := x
+				if d[1]&0x40 != 0 {
+					pos = y
+				}
+				pal := on
+				if pos < split {
+					pal = high
+				} else if pos > split {
+					pal = low
+				}
+				s.attr[y*20+x] = pal
+			}
+		}
+
+	case sgbAttrChr:
+		x, y := int(d[1]), int(d[2])
+		n := int(d[3]) | int(d[4])<<8
+		vertical := d[5] != 0
+		for i := 0; i < n && i < 360 && 6+i/4 < len(d); i++ {
+			if x >= 20 || y >= 18 {
+				break
+			}
+			s.attr[y*20+x] = (d[6+i/4] >> uint(6-(i&3)*2)) & 3
+			if vertical {
+				if y++; y == 18 {
+					y = 0
+					x++
+				}
+			} else {
+				if x++; x == 20 {
+					x = 0
+					y++
+				}
+			}
+		}
+
+	case sgbPalSet:
+		for i := range s.pals {
+			s.pals[i] = s.sysPals[(int(d[1+i*2])|int(d[2+i*2])<<8)&0x1ff]
+		}
+		// color 0 is shared, palette 0's wins
+		for i := range s.pals {
+			s.pals[i][0] = s.pals[0][0]
+		}
+		if d[9]&0x40 != 0 {
+			s.mask = sgbMaskOff
+		}
+
+	case sgbMltReq:
+		s.players = [4]int{1, 2, 1, 4}[d[1]&3]
+		s.player = 0
+
+	case sgbPalTrn, sgbPctTrn:
+		s.transfer = cmd
+
+	case sgbChrTrn:
+		s.transfer = cmd
+		s.chrHigh = d[1]&1 != 0
+
+	case sgbMaskEn:
+		s.mask = d[1] & 3
+		if s.mask == sgbMaskFreeze {
+			s.frozen = append(s.frozen[:0], s.cpu.gpu.frame...)
+		}
+	}
+}
+
+// attrBlock applies one ATTR_BLK data set.
+func (s *SGB) attrBlock(d []byte) {
+	ctrl := d[0] & 7
+	in, border, out := d[1]&3, (d[1]>>2)&3, (d[1]>>4)&3
+	x1, y1, x2, y2 := int(d[2]&0x1f), int(d[3]&0x1f), int(d[4]&0x1f), int(d[5]&0x1f)
+
+	// with only one of inside and outside the border goes along
+	switch ctrl {
+	case 1:
+		ctrl, border = 3, in
+	case 4:
+		ctrl, border = 6, out
+	}
+
+	for y := 0; y < 18; y++ {
+		for x := 0; x < 20; x++ {
+			switch {
+			case x > x1 && x < x2 && y > y1 && y < y2:
+				if ctrl&1 != 0 {
+					s.attr[y*20+x] = in
+				}
+			case x >= x1 && x <= x2 && y >= y1 && y <= y2:
+				if ctrl&2 != 0 {
+					s.attr[y*20+x] = border
+				}
+			default:
+				if ctrl&4 != 0 {
+					s.attr[y*20+x] = out
+				}
+			}
+		}
+	}
+}
+
+// vramData reads the 4k the game shows for a transfer, 256 tiles from the
+// background map in reading order.
+func (s *SGB) vramData() []byte {
+	g := s.cpu.gpu
+	data := make([]byte, 0, 0x1000)
+
+	for i := 0; i < 256; i++ {
+		tile := uint16(g.vram[g.bgmapbase+uint16(i/20)*32+uint16(i%20)])
+		if g.bgtilebase != 0 && tile < 128 {
+			tile += 256
+		}
+		data = append(data, g.vram[tile*16:tile*16+16]...)
+	}
+	return data
+}
+
+// endFrame runs a pending VRAM transfer from the frame just finished.
+func (s *SGB) endFrame() {
+	if s.transfer == 0 {
+		return
+	}
+
+	d := s.vramData()
+	switch s.transfer {
+	case sgbPalTrn:
+		for i := range s.sysPals {
+			for c := 0; c < 4; c++ {
+				s.sysPals[i][c] = color16(d[i*8+c*2:])
+			}
+		}
+
+	case sgbChrTrn:
+		base := 0
+		if s.chrHigh {
+			base = 128
+		}
+		for t := 0; t < 128; t++ {
+			td := d[t*32:]
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					bit := byte(0x80) >> uint(x)
+					var c byte
+					if td[y*2]&bit != 0 {
+						c |= 1
+					}
+					if td[y*2+1]&bit != 0 {
+						c |= 2
+					}
+					if td[16+y*2]&bit != 0 {
+						c |= 4
+					}
+					if td[16+y*2+1]&bit != 0 {
+						c |= 8
+					}
+					s.tiles[base+t][y][x] = c
+				}
+			}
+		}
+
+	case sgbPctTrn:
+		for i := range s.borderMap {
+			s.borderMap[i] = uint16(d[i*2]) | uint16(d[i*2+1])<<8
+		}
+		for p := range s.borderPal {
+			for c := 0; c < 16; c++ {
+				s.borderPal[p][c] = color16(d[0x800+p*32+c*2:])
+			}
+		}
+	}
+
+	s.transfer = 0
+}
+
+// render composes the colored picture and the border into a 256x224 frame
+// of 0x8000 | RGB555 values.
+func (s *SGB) render(frame []uint16) []uint16 {
+	backdrop := 0x8000 | s.pals[0][0]
+
+	for ty := 0; ty < 28; ty++ {
+		for tx := 0; tx < 32; tx++ {
+			e := s.borderMap[ty*32+tx]
+			tile := &s.tiles[e&0xff]
+			pal := &s.borderPal[(e>>10)&3]
+
+			for y := 0; y < 8; y++ {
+				row := y
+				if e&0x8000 != 0 {
+					row = 7 - y
+				}
+				for x := 0; x < 8; x++ {
+					col := x
+					if e&0x4000 != 0 {
+						col = 7 - x
+					}
+
+					v := backdrop
+					if c := tile[row][col]; c != 0 {
+						v = 0x8000 | pal[c]
+					}
+					s.out[(ty*8+y)*SGBWidth+tx*8+x] = v
+				}
+			}
+		}
+	}
+
+	if s.mask == sgbMaskFreeze && s.frozen != nil {
+		frame = s.frozen
+	}
+
+	const left = (SGBWidth - ScreenWidth) / 2
+	const top = (SGBHeight - ScreenHeight) / 2
+	for y := 0; y < ScreenHeight; y++ {
+		for x := 0; x < ScreenWidth; x++ {
+			var v uint16
+			switch s.mask {
+			case sgbMaskBlack:
+				v = 0x8000
+			case sgbMaskColor0:
+				v = backdrop
+			default:
+				shade := frame[y*ScreenWidth+x] & 3
+				v = 0x8000 | s.pals[s.attr[(y>>3)*20+x>>3]][shade]
+			}
+			s.out[(top+y)*SGBWidth+left+x] = v
+		}
+	}
+
+	return s.out
+}
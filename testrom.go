@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// SerialCapture records what test ROMs like Blargg's print to the link
+// port.
+type SerialCapture struct {
+	Echo io.Writer // gets a copy of every byte, may be nil
+	buf  bytes.Buffer
+}
+
+func (s *SerialCapture) Transfer(out byte) byte {
+	s.buf.WriteByte(out)
+	if s.Echo != nil {
+		s.Echo.Write([]byte{out})
+	}
+	return 0xff
+}
+
+func (s *SerialCapture) Receive(out byte) (byte, bool) {
+	return 0, false
+}
+
+func (s *SerialCapture) String() string {
+	return s.buf.String()
+}
+
+type TestResult int
+
+const (
+	TestPassed TestResult = iota
+	TestFailed
+	TestTimeout
+)
+
+func (r TestResult) String() string {
+	return [...]string{"passed", "failed", "timed out"}[r]
+}
+
+// RunSerialTest runs the loaded ROM until it prints "Passed" or "Failed"
+// over the link port, or until maxCycles M-cycles went by. An unknown
+// opcode counts as failure.
+func (c *CPU) RunSerialTest(capture *SerialCapture, maxCycles uint64) TestResult {
+	c.ConnectSerial(capture)
+
+	start := c.Clock
+	checked := 0
+	for c.Clock-start < maxCycles {
+		if !c.Step() {
+			return TestFailed
+		}
+
+		if capture.buf.Len() == checked {
+			continue
+		}
+		checked = capture.buf.Len()
+
+		out := capture.String()
+		if strings.Contains(out, "Passed") {
+			return TestPassed
+		}
+		if strings.Contains(out, "Failed") {
+			return TestFailed
+		}
+	}
+	return TestTimeout
+}
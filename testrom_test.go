@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// serialProgram prints the zero terminated message at 0x170 over the link
+// port, calling a subroutine for every byte, and then spins.
+func serialProgram(message string) []byte {
+	program := []byte{
+		0x21, 0x70, 0x01, // ld hl,$0170
+		0x2a, 0xa7, 0x28, 0x05, // next: ld a,(hl+); and a; jr z,done
+		0xcd, 0x60, 0x01, // call send
+		0x18, 0xf7, // jr next
+		0x18, 0xfe, // done: jr done
+	}
+	program = append(program, make([]byte, 0x10-len(program))...)
+	program = append(program,
+		0xe0, 0x01, 0x3e, 0x81, 0xe0, 0x02, // send: SB = a, start with the internal clock
+		0xf0, 0x02, 0xe6, 0x80, 0x20, 0xfa, // wait until it's out
+		0xc9, // ret
+	)
+	program = append(program, make([]byte, 0x20-len(program))...)
+	return append(program, message+"\x00"...)
+}
+
+func TestRunSerialTest(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		program  []byte
+		want     TestResult
+		captured string // it stops right after the result
+	}{
+		{"passed", serialProgram("cpu_instrs\n\nPassed\n"), TestPassed, "cpu_instrs\n\nPassed"},
+		{"failed", serialProgram("01:01\n\nFailed 1 tests.\n"), TestFailed, "01:01\n\nFailed"},
+		{"timeout", serialProgram("Running\n"), TestTimeout, "Running\n"},
+		{"unknown opcode", []byte{0xd3}, TestFailed, ""},
+	} {
+		c := NewCPU(NewHeadlessBackend())
+		c.LoadROM(programROM(t, false, tc.program))
+
+		var echo bytes.Buffer
+		capture := &SerialCapture{Echo: &echo}
+		if got := c.RunSerialTest(capture, ClockSpeed/4); got != tc.want {
+			t.Errorf("%s: result %v, want %v", tc.name, got, tc.want)
+		}
+		if capture.String() != tc.captured {
+			t.Errorf("%s: captured %q, want %q", tc.name, capture.String(), tc.captured)
+		}
+		if echo.String() != tc.captured {
+			t.Errorf("%s: echoed %q, want %q", tc.name, echo.String(), tc.captured)
+		}
+	}
+}
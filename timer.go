@@ -0,0 +1,72 @@
+package main
+
+// TIMA counts falling edges of one bit of the internal divider.
+var timerBits = [4]uint16{1 << 9, 1 << 3, 1 << 5, 1 << 7}
+
+type Timer struct {
+	cpu *CPU
+
+	div  uint16 // internal counter, DIV is the upper byte
+	tima byte
+	tma  byte
+	tac  byte
+}
+
+func (t *Timer) Tick(cycles uint16) {
+	for i := uint16(0); i < cycles; i += 4 {
+		t.setDiv(t.div + 4)
+	}
+}
+
+func (t *Timer) setDiv(v uint16) {
+	old := t.div
+	t.div = v
+
+	if t.tac&4 != 0 {
+		bit := timerBits[t.tac&3]
+		if old&bit != 0 && v&bit == 0 {
+			t.tima++
+			if t.tima == 0 {
+				t.tima = t.tma
+				t.cpu.If |= 0x04
+			}
+		}
+	}
+
+	// the APU frame sequencer runs off DIV bit 4, bit 5 in double speed
+	// mode so it keeps its 512 Hz
+	seq := uint16(0x1000)
+	if t.cpu.doubleSpeed {
+		seq = 0x2000
+	}
+	if old&seq != 0 && v&seq == 0 {
+		t.cpu.apu.clockSequencer()
+	}
+}
+
+func (t *Timer) ReadByte(addr uint16) byte {
+	switch addr {
+	case 0xff04:
+		return byte(t.div >> 8)
+	case 0xff05:
+		return t.tima
+	case 0xff06:
+		return t.tma
+	case 0xff07:
+		return 0xf8 | t.tac
+	}
+	return 0xff
+}
+
+func (t *Timer) WriteByte(addr uint16, value byte) {
+	switch addr {
+	case 0xff04:
+		t.setDiv(0)
+	case 0xff05:
+		t.tima = value
+	case 0xff06:
+		t.tma = value
+	case 0xff07:
+		t.tac = value & 7
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"math"
+	"os"
+	"strings"
+)
+
+// one frame in the 1/100 s GIF delays, 59.73 fps
+const frameCentis = 100 * CyclesPerFrame / float64(ClockSpeed)
+
+// GIFRecorder collects the frames in memory and writes the file on Close.
+// Frames that would be shown for less than 2/100 s are dropped, browsers
+// slow down anything faster.
+type GIFRecorder struct {
+	path string
+	anim gif.GIF
+	last []byte
+
+	elapsed float64 // centiseconds since the start
+	written int     // sum of the delays so far
+}
+
+func NewGIFRecorder(path string) (*GIFRecorder, error) {
+	// fail now rather than after a long recording
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	return &GIFRecorder{path: path}, nil
+}
+
+func (g *GIFRecorder) AddFrame(img *image.RGBA) error {
+	if g.last != nil && bytes.Equal(g.last, img.Pix) {
+		g.elapsed += frameCentis
+		return nil
+	}
+
+	n := len(g.anim.Image)
+	if n > 0 && int(math.Round(g.elapsed))-g.written < 2 {
+		g.anim.Image[n-1] = toPaletted(img)
+	} else {
+		g.finishFrame()
+		g.anim.Image = append(g.anim.Image, toPaletted(img))
+		g.anim.Delay = append(g.anim.Delay, 0)
+	}
+
+	g.last = append(g.last[:0], img.Pix...)
+	g.elapsed += frameCentis
+	return nil
+}
+
+// finishFrame sets the delay of the last frame to the time until now.
+func (g *GIFRecorder) finishFrame() {
+	n := len(g.anim.Image)
+	if n == 0 {
+		return
+	}
+
+	d := int(math.Round(g.elapsed)) - g.written
+	if d < 2 {
+		d = 2
+	}
+	g.anim.Delay[n-1] = d
+	g.written += d
+}
+
+// toPaletted uses the frame's own colors, a CGB frame with more than 256
+// is mapped to a fixed palette.
+func toPaletted(img *image.RGBA) *image.Paletted {
+	pal := color.Palette{}
+	index := make(map[color.RGBA]uint8)
+	for i := 0; i < len(img.Pix); i += 4 {
+		c := color.RGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], 0xff}
+		if _, ok := index[c]; ok {
+			continue
+		}
+		if len(pal) == 256 {
+			pal = nil
+			break
+		}
+		index[c] = uint8(len(pal))
+		pal = append(pal, c)
+	}
+
+	if pal == nil {
+		dst := image.NewPaletted(img.Rect, palette.Plan9)
+		draw.Draw(dst, img.Rect, img, image.Point{}, draw.Src)
+		return dst
+	}
+
+	dst := image.NewPaletted(img.Rect, pal)
+	for i := 0; i < len(img.Pix); i += 4 {
+		dst.Pix[i/4] = index[color.RGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], 0xff}]
+	}
+	return dst
+}
+
+func (g *GIFRecorder) Close() error {
+	g.finishFrame()
+
+	f, err := os.Create(g.path)
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(f, &g.anim); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Y4MRecorder streams uncompressed 4:4:4 YUV frames, most video tools can
+// read it and mux it with the WAV written alongside. The size is taken from
+// the first frame.
+type Y4MRecorder struct {
+	f *os.File
+	w *bufio.Writer
+
+	width  int
+	height int
+	planes []byte
+}
+
+func NewY4MRecorder(path string) (*Y4MRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Y4MRecorder{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (y *Y4MRecorder) AddFrame(img *image.RGBA) error {
+	if y.planes == nil {
+		y.width, y.height = img.Rect.Dx(), img.Rect.Dy()
+		y.planes = make([]byte, y.width*y.height*3)
+		if _, err := fmt.Fprintf(y.w, "YUV4MPEG2 W%d H%d F%d:%d Ip A1:1 C444\n", y.width, y.height, ClockSpeed, CyclesPerFrame); err != nil {
+			return err
+		}
+	}
+	if img.Rect.Dx() != y.width || img.Rect.Dy() != y.height {
+		return fmt.Errorf("frame size changed to %v", img.Rect.Size())
+	}
+
+	n := y.width * y.height
+	for i := 0; i < n; i++ {
+		r := float64(img.Pix[i*4])
+		g := float64(img.Pix[i*4+1])
+		b := float64(img.Pix[i*4+2])
+
+		// BT.601, studio range
+		y.planes[i] = byte(16 + (65.738*r+129.057*g+25.064*b)/256)
+		y.planes[n+i] = byte(128 + (-37.945*r-74.494*g+112.439*b)/256)
+		y.planes[2*n+i] = byte(128 + (112.439*r-94.154*g-18.285*b)/256)
+	}
+
+	if _, err := y.w.WriteString("FRAME\n"); err != nil {
+		return err
+	}
+	_, err := y.w.Write(y.planes)
+	return err
+}
+
+func (y *Y4MRecorder) Close() error {
+	if err := y.w.Flush(); err != nil {
+		y.f.Close()
+		return err
+	}
+	return y.f.Close()
+}
+
+// StartGIF records every frame into an animated GIF until StopGIF.
+func (c *CPU) StartGIF(path string) error {
+	c.StopGIF()
+
+	r, err := NewGIFRecorder(path)
+	if err != nil {
+		return err
+	}
+	c.gifRecorder = r
+	return nil
+}
+
+func (c *CPU) StopGIF() error {
+	if c.gifRecorder == nil {
+		return nil
+	}
+
+	err := c.gifRecorder.Close()
+	c.gifRecorder = nil
+	return err
+}
+
+// StartVideo dumps every frame to a Y4M file and the sound to a WAV file
+// next to it. The WAV is separate from StartRecording's and has the nominal
+// sample rate, so it stays in sync with the frames.
+func (c *CPU) StartVideo(path string) error {
+	c.StopVideo()
+
+	r, err := NewY4MRecorder(path)
+	if err != nil {
+		return err
+	}
+	wav := strings.TrimSuffix(path, ".y4m") + ".wav"
+	w, err := NewSoundRecorder(wav, c.apu.rate, false)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	c.videoRecorder = r
+	c.apu.videoSound = w
+	return nil
+}
+
+func (c *CPU) StopVideo() error {
+	if c.videoRecorder == nil {
+		return nil
+	}
+
+	err := c.videoRecorder.Close()
+	c.videoRecorder = nil
+	if c.apu.videoSound != nil {
+		if werr := c.apu.videoSound.Close(); err == nil {
+			err = werr
+		}
+		c.apu.videoSound = nil
+	}
+	return err
+}
+
+// recordFrame hands the presented frame to the running recorders.
+func (c *CPU) recordFrame() {
+	if c.gifRecorder == nil && c.videoRecorder == nil {
+		return
+	}
+
+	img := c.FrameImage()
+	if c.gifRecorder != nil {
+		if err := c.gifRecorder.AddFrame(img); err != nil {
+			fmt.Printf("GIF recording failed: %v\n", err)
+			c.StopGIF()
+		}
+	}
+	if c.videoRecorder != nil {
+		if err := c.videoRecorder.AddFrame(img); err != nil {
+			fmt.Printf("Video recording failed: %v\n", err)
+			c.StopVideo()
+		}
+	}
+}
+
+func (c *CPU) toggleGIF() {
+	if c.gifRecorder != nil {
+		if err := c.StopGIF(); err != nil {
+			fmt.Printf("GIF recording failed: %v\n", err)
+		}
+		return
+	}
+
+	name := timestamped("gif")
+	if err := c.StartGIF(name); err != nil {
+		fmt.Printf("GIF recording failed: %v\n", err)
+		return
+	}
+	fmt.Printf("Recording GIF to %s\n", name)
+}
+
+func (c *CPU) toggleVideo() {
+	if c.videoRecorder != nil {
+		if err := c.StopVideo(); err != nil {
+			fmt.Printf("Video recording failed: %v\n", err)
+		}
+		return
+	}
+
+	name := timestamped("y4m")
+	if err := c.StartVideo(name); err != nil {
+		fmt.Printf("Video recording failed: %v\n", err)
+		return
+	}
+	fmt.Printf("Recording video to %s\n", name)
+}
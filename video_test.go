@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A video has its own WAV at the nominal rate, next to a running sound
+// recording and whatever the rate control does.
+func TestVideoSound(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestCPU(t, ModelDMG)
+	c.apu.ratio = 0.995
+
+	if err := c.apu.StartRecording(filepath.Join(dir, "sound.wav"), false); err != nil {
+		t.Fatal(err)
+	}
+	defer c.apu.StopRecording()
+	if err := c.StartVideo(filepath.Join(dir, "video.y4m")); err != nil {
+		t.Fatal(err)
+	}
+	start := c.dots
+	c.RunFrames(60)
+	if err := c.StopVideo(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.apu.Recording() {
+		t.Error("stopping the video stopped the sound recording")
+	}
+
+	wav, err := os.ReadFile(filepath.Join(dir, "video.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := int(binary.LittleEndian.Uint32(wav[40:])) / 4
+	want := int((c.dots - start) * uint64(c.apu.rate) / ClockSpeed)
+	if got < want-1 || got > want+1 {
+		t.Errorf("video has %d samples, want %d", got, want)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// WAVWriter writes 16 bit PCM, the sizes in the header are filled in by Close.
+type WAVWriter struct {
+	f *os.File
+	w *bufio.Writer
+
+	channels int
+	rate     int
+	size     uint32 // bytes of sample data
+}
+
+func CreateWAV(path string, rate, channels int) (*WAVWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAVWriter{f: f, w: bufio.NewWriter(f), channels: channels, rate: rate}
+	if err := w.header(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WAVWriter) header() error {
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+w.size)
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], uint16(w.channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(w.rate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(w.rate*w.channels*2))
+	binary.LittleEndian.PutUint16(h[32:], uint16(w.channels*2))
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], w.size)
+
+	_, err := w.w.Write(h)
+	return err
+}
+
+// Write takes interleaved samples.
+func (w *WAVWriter) Write(samples []int16) error {
+	var b [2]byte
+	for _, s := range samples {
+		binary.LittleEndian.PutUint16(b[:], uint16(s))
+		if _, err := w.w.Write(b[:]); err != nil {
+			return err
+		}
+	}
+	w.size += uint32(len(samples) * 2)
+	return nil
+}
+
+func (w *WAVWriter) Close() error {
+	if err := w.w.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+
+	if _, err := w.f.Seek(0, 0); err != nil {
+		w.f.Close()
+		return err
+	}
+	w.w.Reset(w.f)
+	if err := w.header(); err != nil {
+		w.f.Close()
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+
+	return w.f.Close()
+}
+
+// SoundRecorder dumps the stereo mix, and optionally every channel on its
+// own, to WAV files.
+type SoundRecorder struct {
+	mix      *WAVWriter
+	channels [4]*WAVWriter
+}
+
+// NewSoundRecorder writes the mix to path, per channel files get -ch1 to
+// -ch4 added to the name.
+func NewSoundRecorder(path string, rate int, perChannel bool) (*SoundRecorder, error) {
+	r := new(SoundRecorder)
+
+	var err error
+	if r.mix, err = CreateWAV(path, rate, 2); err != nil {
+		return nil, err
+	}
+
+	if perChannel {
+		base := strings.TrimSuffix(path, ".wav")
+		for i := range r.channels {
+			if r.channels[i], err = CreateWAV(fmt.Sprintf("%s-ch%d.wav", base, i+1), rate, 1); err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return r, nil
+}
+
+func (r *SoundRecorder) add(left, right int16, channels [4]float32) error {
+	if err := r.mix.Write([]int16{left, right}); err != nil {
+		return err
+	}
+
+	for i, w := range r.channels {
+		if w == nil {
+			continue
+		}
+		if err := w.Write([]int16{clamp(channels[i])}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SoundRecorder) Close() error {
+	var ret error
+	if r.mix != nil {
+		ret = r.mix.Close()
+	}
+	for _, w := range r.channels {
+		if w == nil {
+			continue
+		}
+		if err := w.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}